@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -15,6 +16,7 @@ import (
 	"github.com/f110/git-lfs-cloud/config"
 	"github.com/f110/git-lfs-cloud/database"
 	"github.com/f110/git-lfs-cloud/lfs"
+	"github.com/f110/git-lfs-cloud/storage"
 	"github.com/gliderlabs/ssh"
 )
 
@@ -22,15 +24,18 @@ const (
 	HostKeyBits              = 4096
 	TokenExpire              = 3600 // 1 hour
 	AuthenticateCommand      = "git-lfs-authenticate"
+	TransferCommand          = "git-lfs-transfer"
 	AdminCommand             = "git-lfs-admin"
 	AdminOperationWhoAmI     = "whoami"
 	AdminOperationInvalidate = "invalidate"
+	AdminOperationLsObjects  = "ls-objects"
+	AdminOperationCacheStats = "cache-stats"
 )
 
 type Authenticate struct {
 	Header    map[string]string `json:"header"`
 	ExpiresIn int               `json:"expires_in,omitempty"`
-	ExpiresAt int               `json:"expires_at,omitempty"`
+	ExpiresAt string            `json:"expires_at,omitempty"`
 }
 
 func generateHostKey() ([]byte, error) {
@@ -73,7 +78,8 @@ func handleDownload(session ssh.Session, user, repo string) {
 	}
 	auth := &Authenticate{
 		Header:    map[string]string{"Authorization": "Bearer " + sess.ID},
-		ExpiresIn: int(time.Now().Unix() + TokenExpire),
+		ExpiresIn: TokenExpire,
+		ExpiresAt: time.Now().Add(TokenExpire * time.Second).UTC().Format(time.RFC3339),
 	}
 	buf, err := json.Marshal(auth)
 	if err != nil {
@@ -105,31 +111,71 @@ func handleInvalidate(session ssh.Session, user, repo string) {
 	io.WriteString(session, "Success invalidate cache\n")
 }
 
-func authenticateCommand(s ssh.Session, operation, repo string) {
-	username := ""
+// handleLsObjects writes the object id, the size and the last modified time of each object of the repository.
+func handleLsObjects(session ssh.Session, server *lfs.Server, user, repo string) {
+	if isRepositoryUser(user, repo) == false {
+		io.WriteString(session.Stderr(), "permission denied\n")
+		session.Exit(1)
+		return
+	}
+
+	err := server.ListObjects(context.Background(), repo, func(o *storage.ListedObject) error {
+		_, err := fmt.Fprintf(session, "%s\t%d\t%s\n", o.ObjectID, o.Size, o.LastModified.UTC().Format(time.RFC3339))
+		return err
+	})
+	if err != nil {
+		log.Print(err)
+		io.WriteString(session.Stderr(), "failed to list objects\n")
+		session.Exit(1)
+	}
+}
+
+// handleCacheStats writes the accounting of the cache of the repository which uses cached storage.
+func handleCacheStats(session ssh.Session, server *lfs.Server, user, repo string) {
+	if isRepositoryUser(user, repo) == false {
+		io.WriteString(session.Stderr(), "permission denied\n")
+		session.Exit(1)
+		return
+	}
+
+	stats, err := server.CacheStats(repo)
+	if err != nil {
+		io.WriteString(session.Stderr(), err.Error()+"\n")
+		session.Exit(1)
+		return
+	}
+	fmt.Fprintf(session, "hits\t%d\nmisses\t%d\nevictions\t%d\nobjects\t%d\nsize\t%d\n", stats.Hits, stats.Misses, stats.Evictions, stats.Objects, stats.Size)
+}
+
+// findUsername returns the name of the user who owns the public key of the session.
+func findUsername(s ssh.Session) string {
 	pubKey := s.PublicKey()
-FindUserLoop:
 	for user, pubKeys := range PermitPublicKeys {
 		for _, pub := range pubKeys {
 			if ssh.KeysEqual(pubKey, pub) {
-				username = user
-				break FindUserLoop
+				return user
 			}
 		}
 	}
+	return ""
+}
 
+func isRepositoryUser(username, repo string) bool {
 	users, err := database.ReadRepositoryUsers(repo)
 	if err != nil {
-		return
+		return false
 	}
-	authenticated := false
 	for _, u := range users {
 		if u == username {
-			authenticated = true
-			break
+			return true
 		}
 	}
-	if authenticated == false {
+	return false
+}
+
+func authenticateCommand(s ssh.Session, operation, repo string) {
+	username := findUsername(s)
+	if isRepositoryUser(username, repo) == false {
 		return
 	}
 
@@ -143,30 +189,77 @@ FindUserLoop:
 	}
 }
 
-func adminCommand(s ssh.Session, operation, repo string) {
-	username := ""
-	pubKey := s.PublicKey()
-FindUserLoop:
-	for user, pubKeys := range PermitPublicKeys {
-		for _, pub := range pubKeys {
-			if ssh.KeysEqual(pubKey, pub) {
-				username = user
-				break FindUserLoop
-			}
-		}
+func transferCommand(s ssh.Session, server *lfs.Server, operation, repo string) {
+	username := findUsername(s)
+	if isRepositoryUser(username, repo) == false {
+		io.WriteString(s.Stderr(), "permission denied\n")
+		s.Exit(1)
+		return
 	}
+	if operation != lfs.OperationDownload && operation != lfs.OperationUpload {
+		io.WriteString(s.Stderr(), "not supported operation\n")
+		s.Exit(1)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := server.ServeTransfer(ctx, &sessionReadWriter{Session: s, cancel: cancel}, repo, username, operation)
+	if err != nil {
+		log.Print(err)
+		s.Exit(1)
+	}
+}
+
+// sessionReadWriter cancels the context of the session when the session is closed.
+// gliderlabs/ssh v0.1.0 doesn't have the context of the session, so the closed session is detected by the error of reading or writing.
+type sessionReadWriter struct {
+	ssh.Session
+	cancel context.CancelFunc
+}
+
+func (s *sessionReadWriter) Read(p []byte) (int, error) {
+	n, err := s.Session.Read(p)
+	if err != nil {
+		s.cancel()
+	}
+	return n, err
+}
+
+func (s *sessionReadWriter) Write(p []byte) (int, error) {
+	n, err := s.Session.Write(p)
+	if err != nil {
+		s.cancel()
+	}
+	return n, err
+}
+
+func adminCommand(s ssh.Session, server *lfs.Server, operation, repo string) {
+	username := findUsername(s)
 
 	switch operation {
 	case AdminOperationWhoAmI:
 		handleWhoAmI(s, username, repo)
 	case AdminOperationInvalidate:
 		handleInvalidate(s, username, repo)
+	case AdminOperationLsObjects:
+		handleLsObjects(s, server, username, strings.TrimPrefix(repo, "/"))
+	case AdminOperationCacheStats:
+		handleCacheStats(s, server, username, strings.TrimPrefix(repo, "/"))
 	default:
 		io.WriteString(s, "not supported operation")
 	}
 }
 
-func SSHServer() {
+// parseCommand returns the repository and the operation of the command (e.g. git-lfs-transfer owner/repo.git upload).
+func parseCommand(command []string) (repo, operation string, ok bool) {
+	if len(command) < 3 || strings.HasSuffix(command[1], ".git") == false {
+		return "", "", false
+	}
+	return strings.TrimSuffix(command[1], ".git"), command[2], true
+}
+
+func SSHServer(server *lfs.Server) {
 	hostKey, err := readOrGenerateHostKey()
 	if err != nil {
 		log.Print(err)
@@ -175,16 +268,33 @@ func SSHServer() {
 	hostKeyOption := ssh.HostKeyPEM(hostKey)
 
 	ssh.Handle(func(s ssh.Session) {
-		switch s.Command()[0] {
-		case AuthenticateCommand:
-			authenticateCommand(s, s.Command()[2], s.Command()[1][:strings.Index(s.Command()[1], ".git")])
-		case AdminCommand:
-			adminCommand(s, s.Command()[2], s.Command()[1][:strings.Index(s.Command()[1], ".git")])
+		command := s.Command()
+		if len(command) == 0 {
+			io.WriteString(s, "not supported\n")
+			return
+		}
+		switch command[0] {
+		case AuthenticateCommand, TransferCommand, AdminCommand:
 		default:
 			io.WriteString(s, "not supported\n")
 			return
 		}
+		// The panic in the session isn't recovered, so the malformed command must not reach the handlers
+		repo, operation, ok := parseCommand(command)
+		if ok == false {
+			io.WriteString(s.Stderr(), "usage: "+command[0]+" <owner/repo.git> <operation>\n")
+			s.Exit(1)
+			return
+		}
 
+		switch command[0] {
+		case AuthenticateCommand:
+			authenticateCommand(s, operation, repo)
+		case TransferCommand:
+			transferCommand(s, server, operation, strings.TrimPrefix(repo, "/"))
+		case AdminCommand:
+			adminCommand(s, server, operation, repo)
+		}
 	})
 
 	publicKeyOption := ssh.PublicKeyAuth(func(user string, key ssh.PublicKey) bool {
@@ -1,7 +1,16 @@
 package config
 
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
 type Config struct {
 	Host           string
+	URL            string `toml:"url"`
 	CertFile       string `toml:"cert_file"`
 	KeyFile        string `toml:"key_file"`
 	DisableHttps   bool   `toml:"disable_https"`
@@ -10,6 +19,13 @@ type Config struct {
 	LocalCacheFile string `toml:"local_cache_file"`
 	Organizations  []string
 	GitHub         GitHubConfig
+
+	BatchConcurrency int      `toml:"batch_concurrency"`
+	BatchTimeout     Duration `toml:"batch_timeout"`
+	MaxBatchSize     int      `toml:"max_batch_size"`
+
+	// Pools are the storages which are shared by repositories. Objects in the pool are deduplicated across repositories.
+	Pools map[string]*RepositoryConfig
 }
 
 type GitHubConfig struct {
@@ -17,11 +33,85 @@ type GitHubConfig struct {
 }
 
 type RepositoryConfig struct {
-	Owner          string
-	Repo           string
-	Storage        string
-	CredentialFile string `toml:"credential_file"`
-	AccessID       string `toml:"access_id"`
-	Bucket         string
-	Region         string
+	Owner   string
+	Repo    string
+	Storage string
+	Bucket  string
+	// SigningKey signs the URL of objects which are served by lfs server itself
+	SigningKey    string   `toml:"signing_key"`
+	VerifyContent bool     `toml:"verify_content"`
+	URLExpire     Duration `toml:"url_expire"`
+	// MultipartThreshold is the size of the object which is uploaded by multipart upload
+	MultipartThreshold int64 `toml:"multipart_threshold"`
+	// Backend is the storage which is wrapped by the storage of the repository (e.g. encrypted, replicated, cached).
+	Backend *RepositoryConfig
+	// Replicas are the storages which the objects of backend are copied to by replicated storage
+	Replicas []*RepositoryConfig
+	// KeyLayout is the layout of object keys. If not specified, the default layout of the storage is used.
+	KeyLayout *KeyLayout `toml:"key_layout"`
+	// Aliases are the former names of the repository. The objects in the key space of aliases are still downloadable.
+	Aliases []string
+	// Mode is either "direct" (default) or "proxy". In proxy mode, objects are transferred through lfs server.
+	Mode string
+	// Pool is the name of the pool which stores objects of the repository instead of the storage of the repository.
+	Pool string
+	// Upstream is the LFS server which objects missing from the storage are fetched from.
+	Upstream *UpstreamConfig
+	// MigrateTo is the storage which the objects are copied to by the migrate command.
+	// The repository is switched to it when all objects have been copied.
+	MigrateTo *RepositoryConfig `toml:"migrate_to"`
+	// Drivers are the sections of storage drivers (e.g. [repositories."f110/test1".s3]) which are keyed by the driver name.
+	// The section of the driver of the repository is decoded by the driver.
+	Drivers map[string]DriverConfig `toml:"-"`
+	// Admins are the users who can force-unlock the locks of other users
+	Admins []string
+}
+
+// UpstreamConfig is the LFS server which the repository is migrated from.
+type UpstreamConfig struct {
+	// URL is the LFS endpoint of the upstream (e.g. https://github.com/f110/test1.git/info/lfs)
+	URL      string `toml:"url"`
+	Username string
+	Password string
+	// Token is sent as the bearer token instead of Username and Password
+	Token string
+}
+
+// KeyLayout is the layout of object keys in the bucket.
+type KeyLayout struct {
+	Prefix string
+	Shard  bool
+	// Scope is either "repository" (default) or "global". "global" is allowed only in [pools]
+	Scope string
+}
+
+// DriverConfig is the configuration section of the storage driver.
+type DriverConfig map[string]interface{}
+
+// Decode decodes the section into v which is the pointer to the configuration of the driver.
+// Decode fails if the section has a key which v doesn't have.
+func (c DriverConfig) Decode(v interface{}) error {
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(map[string]interface{}(c)); err != nil {
+		return err
+	}
+	md, err := toml.Decode(buf.String(), v)
+	if err != nil {
+		return err
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return fmt.Errorf("unknown options: %v", keys)
+	}
+	return nil
+}
+
+// BaseURL returns the URL of lfs server which is used in hrefs served by lfs server itself.
+func (c *Config) BaseURL() string {
+	if c.URL != "" {
+		return strings.TrimSuffix(c.URL, "/")
+	}
+	if c.DisableHttps {
+		return "http://" + c.Host + ":8080"
+	}
+	return "https://" + c.Host
 }
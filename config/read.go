@@ -1,18 +1,91 @@
 package config
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
+// movedKeys are the options of drivers which had been in the section of the repository before drivers got their own sections.
+var movedKeys = map[string]bool{
+	"credential_file":    true,
+	"access_id":          true,
+	"region":             true,
+	"path":               true,
+	"part_size":          true,
+	"upload_concurrency": true,
+}
+
 func Read(filePath string) (Config, error) {
 	config := &Config{}
 	_, err := toml.DecodeFile(filePath, config)
+	if err != nil {
+		return *config, err
+	}
 	for k, v := range config.Repositories {
 		s := strings.Split(k, "/")
 		v.Owner = s[0]
 		v.Repo = s[1]
 	}
-	return *config, err
+
+	// The sections of drivers are not known until the drivers decode them
+	raw := make(map[string]interface{})
+	if _, err := toml.DecodeFile(filePath, &raw); err != nil {
+		return *config, err
+	}
+	repos, _ := raw["repositories"].(map[string]interface{})
+	for k, v := range config.Repositories {
+		if err := readDrivers(v, repos[k], fmt.Sprintf("repositories.%q", k), config.Storage); err != nil {
+			return *config, err
+		}
+	}
+	pools, _ := raw["pools"].(map[string]interface{})
+	for k, v := range config.Pools {
+		if err := readDrivers(v, pools[k], fmt.Sprintf("pools.%q", k), config.Storage); err != nil {
+			return *config, err
+		}
+	}
+	return *config, nil
+}
+
+// readDrivers sets the tables of the repository which are not the fields of RepositoryConfig to Drivers.
+// readDrivers fails if the options of the driver are still in the section of the repository.
+func readDrivers(repoConf *RepositoryConfig, raw interface{}, name, defaultStorage string) error {
+	m, ok := raw.(map[string]interface{})
+	if repoConf == nil || ok == false {
+		return nil
+	}
+	driver := repoConf.Storage
+	if driver == "" {
+		driver = defaultStorage
+	}
+	repoConf.Drivers = make(map[string]DriverConfig)
+	for k, v := range m {
+		switch k {
+		case "backend", "key_layout", "upstream", "migrate_to":
+			continue
+		}
+		if section, ok := v.(map[string]interface{}); ok {
+			repoConf.Drivers[k] = DriverConfig(section)
+			continue
+		}
+		if movedKeys[k] {
+			return fmt.Errorf("config: %s: %s has moved to [%s.%s]", name, k, name, driver)
+		}
+	}
+
+	if err := readDrivers(repoConf.Backend, m["backend"], name+".backend", defaultStorage); err != nil {
+		return err
+	}
+	if err := readDrivers(repoConf.MigrateTo, m["migrate_to"], name+".migrate_to", defaultStorage); err != nil {
+		return err
+	}
+	replicas, _ := m["replicas"].([]map[string]interface{})
+	for i := 0; i < len(replicas) && i < len(repoConf.Replicas); i++ {
+		if err := readDrivers(repoConf.Replicas[i], replicas[i], name+".replicas", defaultStorage); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+var (
+	BucketDataKeys = []byte("DataKeys")
+)
+
+// CreateDataKey saves the wrapped data key of name in namespace if the key doesn't exist yet.
+// CreateDataKey returns the saved key, so the existing key wins when the key is created concurrently.
+// The namespace separates the keys which are wrapped by different master keys.
+func CreateDataKey(namespace, name string, wrapped []byte) ([]byte, error) {
+	var saved []byte
+	err := Conn.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(BucketDataKeys)
+		if err != nil {
+			return err
+		}
+		b, err := root.CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+		if v := b.Get([]byte(name)); v != nil {
+			saved = append([]byte{}, v...)
+			return nil
+		}
+
+		saved = wrapped
+		return b.Put([]byte(name), wrapped)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func ReadDataKey(namespace, name string) ([]byte, error) {
+	tx, err := Conn.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	b := dataKeyBucket(tx, namespace)
+	if b == nil {
+		return nil, ErrNotFound
+	}
+	v := b.Get([]byte(name))
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, v...), nil
+}
+
+// UpdateDataKeys replaces each wrapped data key in namespace with the result of fn, and returns the number of replaced keys.
+// If fn returns nil, the key is kept as it is.
+func UpdateDataKeys(namespace string, fn func(name string, wrapped []byte) ([]byte, error)) (int, error) {
+	updated := 0
+	err := Conn.Update(func(tx *bolt.Tx) error {
+		b := dataKeyBucket(tx, namespace)
+		if b == nil {
+			return nil
+		}
+
+		newKeys := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			newKey, err := fn(string(k), v)
+			if err != nil {
+				return err
+			}
+			if newKey != nil {
+				newKeys[string(k)] = newKey
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// The bucket can't be modified while iterating
+		for k, v := range newKeys {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		updated = len(newKeys)
+		return nil
+	})
+	return updated, err
+}
+
+func dataKeyBucket(tx *bolt.Tx, namespace string) *bolt.Bucket {
+	root := tx.Bucket(BucketDataKeys)
+	if root == nil {
+		return nil
+	}
+	return root.Bucket([]byte(namespace))
+}
@@ -19,6 +19,7 @@ var (
 	BucketCredential      = []byte("Credential")
 	BucketPublicKeys      = []byte("PublicKeys")
 	BucketRepositoryUsers = []byte("RepoUsers")
+	BucketLocks           = []byte("Locks")
 	KeyHostKey            = []byte("HostKey")
 )
 
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	ErrLockExists = errors.New("lock already exists")
+)
+
+type Lock struct {
+	ID       string
+	Path     string
+	Owner    string
+	LockedAt time.Time
+}
+
+func newLockID() (string, error) {
+	buf := make([]byte, 20)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", buf), nil
+}
+
+// CreateLock creates the lock of path in repo.
+// If the path is already locked, CreateLock returns the existing lock with ErrLockExists.
+func CreateLock(repo, path, owner string) (*Lock, error) {
+	id, err := newLockID()
+	if err != nil {
+		return nil, err
+	}
+	lock := &Lock{ID: id, Path: path, Owner: owner, LockedAt: time.Now().UTC().Truncate(time.Second)}
+
+	var exists *Lock
+	err = Conn.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(BucketLocks)
+		if err != nil {
+			return err
+		}
+		b, err := root.CreateBucketIfNotExists([]byte(repo))
+		if err != nil {
+			return err
+		}
+
+		err = b.ForEach(func(k, v []byte) error {
+			l := &Lock{}
+			if err := json.Unmarshal(v, l); err != nil {
+				return err
+			}
+			if l.Path == path {
+				exists = l
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if exists != nil {
+			return ErrLockExists
+		}
+
+		value, err := json.Marshal(lock)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(lock.ID), value)
+	})
+	if err == ErrLockExists {
+		return exists, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// ReadLocks returns all locks of repo ordered by ID.
+func ReadLocks(repo string) ([]*Lock, error) {
+	tx, err := Conn.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	locks := make([]*Lock, 0)
+	root := tx.Bucket(BucketLocks)
+	if root == nil {
+		return locks, nil
+	}
+	b := root.Bucket([]byte(repo))
+	if b == nil {
+		return locks, nil
+	}
+
+	err = b.ForEach(func(k, v []byte) error {
+		l := &Lock{}
+		if err := json.Unmarshal(v, l); err != nil {
+			return err
+		}
+		locks = append(locks, l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return locks, nil
+}
+
+func ReadLock(repo, id string) (*Lock, error) {
+	tx, err := Conn.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	root := tx.Bucket(BucketLocks)
+	if root == nil {
+		return nil, ErrNotFound
+	}
+	b := root.Bucket([]byte(repo))
+	if b == nil {
+		return nil, ErrNotFound
+	}
+
+	buf := b.Get([]byte(id))
+	if buf == nil {
+		return nil, ErrNotFound
+	}
+	lock := &Lock{}
+	err = json.Unmarshal(buf, lock)
+	if err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+func DeleteLock(repo, id string) error {
+	return Conn.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(BucketLocks)
+		if root == nil {
+			return ErrNotFound
+		}
+		b := root.Bucket([]byte(repo))
+		if b == nil || b.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+
+		return b.Delete([]byte(id))
+	})
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	BucketMigration = []byte("Migration")
+)
+
+// Migration is the checkpoint of copying the key space of the repository to another storage.
+type Migration struct {
+	Repo     string
+	KeySpace string
+	// Cursor is the list cursor of the objects which have not been copied yet
+	Cursor    string
+	Copied    int64
+	Skipped   int64
+	Completed bool
+	// StartedAt is the time when the current pass started
+	StartedAt time.Time
+	// SyncedAt is the time when the last completed pass started. The objects uploaded to the source before it have been copied.
+	SyncedAt time.Time
+	// SwitchedAt is the time when lfs server switched the repository to the destination
+	SwitchedAt time.Time
+	UpdatedAt  time.Time
+}
+
+func (m *Migration) key() []byte {
+	return []byte(m.Repo + "\x00" + m.KeySpace)
+}
+
+func ReadMigration(repo, keySpace string) (*Migration, error) {
+	tx, err := Conn.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	b := tx.Bucket(BucketMigration)
+	if b == nil {
+		return nil, ErrNotFound
+	}
+	m := &Migration{Repo: repo, KeySpace: keySpace}
+	v := b.Get(m.key())
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	if err := json.Unmarshal(v, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func SaveMigration(m *Migration) error {
+	m.UpdatedAt = time.Now()
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return Conn.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(BucketMigration)
+		if err != nil {
+			return err
+		}
+		return b.Put(m.key(), value)
+	})
+}
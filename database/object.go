@@ -0,0 +1,186 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	BucketObjects = []byte("Objects")
+)
+
+// ObjectMetadata is the entry of the object index. The index is kept per repository.
+type ObjectMetadata struct {
+	Repo     string
+	ObjectID string
+	Size     int64
+	// Uploader is empty if the object was stored without the upload (e.g. fetched from the upstream)
+	Uploader         string
+	UploadedAt       time.Time
+	LastDownloadedAt time.Time
+	// DownloadCount is the number of the download actions issued for the object.
+	// The transfer itself is not counted, so the resumed or failed transfer doesn't change it.
+	DownloadCount int64
+}
+
+// RepositoryUsage is the summary of the object index of the repository.
+type RepositoryUsage struct {
+	Repo          string
+	Objects       int64
+	Size          int64
+	DownloadCount int64
+}
+
+// RecordObjectUpload adds the verified object to the index.
+// The object which is already in the index keeps the first uploader and the download statistics.
+func RecordObjectUpload(repo, oid string, size int64, uploader string) error {
+	return updateObjectMetadata(repo, oid, func(m *ObjectMetadata) {
+		m.Size = size
+		if m.UploadedAt.IsZero() {
+			m.Uploader = uploader
+			m.UploadedAt = time.Now()
+		}
+	})
+}
+
+// RecordObjectDownload counts the download of the object.
+// The object which is not in the index (e.g. uploaded before the index exists) is added without the uploader.
+func RecordObjectDownload(repo, oid string, size int64) error {
+	return updateObjectMetadata(repo, oid, func(m *ObjectMetadata) {
+		m.Size = size
+		m.LastDownloadedAt = time.Now()
+		m.DownloadCount++
+	})
+}
+
+// updateObjectMetadata is called for every download, so concurrent updates are coalesced into one transaction.
+// fn may be called more than once because the update is retried when the other update in the batch fails.
+func updateObjectMetadata(repo, oid string, fn func(*ObjectMetadata)) error {
+	return Conn.Batch(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(BucketObjects)
+		if err != nil {
+			return err
+		}
+		b, err := root.CreateBucketIfNotExists([]byte(repo))
+		if err != nil {
+			return err
+		}
+
+		m := &ObjectMetadata{Repo: repo, ObjectID: oid}
+		if v := b.Get([]byte(oid)); v != nil {
+			if err := json.Unmarshal(v, m); err != nil {
+				return err
+			}
+		}
+		fn(m)
+		value, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(oid), value)
+	})
+}
+
+func ReadObjectMetadata(repo, oid string) (*ObjectMetadata, error) {
+	tx, err := Conn.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	root := tx.Bucket(BucketObjects)
+	if root == nil {
+		return nil, ErrNotFound
+	}
+	b := root.Bucket([]byte(repo))
+	if b == nil {
+		return nil, ErrNotFound
+	}
+	v := b.Get([]byte(oid))
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	m := &ObjectMetadata{}
+	if err := json.Unmarshal(v, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadObjectMetadataList returns the objects of the repository which match filter.
+// If filter is nil, all objects of the repository are returned.
+func ReadObjectMetadataList(repo string, filter func(*ObjectMetadata) bool) ([]*ObjectMetadata, error) {
+	objects := make([]*ObjectMetadata, 0)
+	err := forEachObjectMetadata(repo, func(m *ObjectMetadata) {
+		if filter == nil || filter(m) {
+			objects = append(objects, m)
+		}
+	})
+	return objects, err
+}
+
+// ReadObjectsUploadedBy returns the objects which the user uploaded to any repository.
+func ReadObjectsUploadedBy(uploader string) ([]*ObjectMetadata, error) {
+	tx, err := Conn.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	objects := make([]*ObjectMetadata, 0)
+	root := tx.Bucket(BucketObjects)
+	if root == nil {
+		return objects, nil
+	}
+	err = root.ForEach(func(repo, _ []byte) error {
+		return root.Bucket(repo).ForEach(func(_, v []byte) error {
+			m := &ObjectMetadata{}
+			if err := json.Unmarshal(v, m); err != nil {
+				return err
+			}
+			if m.Uploader == uploader {
+				objects = append(objects, m)
+			}
+			return nil
+		})
+	})
+	return objects, err
+}
+
+// ReadRepositoryUsage sums up the objects in the index of the repository.
+func ReadRepositoryUsage(repo string) (*RepositoryUsage, error) {
+	usage := &RepositoryUsage{Repo: repo}
+	err := forEachObjectMetadata(repo, func(m *ObjectMetadata) {
+		usage.Objects++
+		usage.Size += m.Size
+		usage.DownloadCount += m.DownloadCount
+	})
+	return usage, err
+}
+
+func forEachObjectMetadata(repo string, fn func(*ObjectMetadata)) error {
+	tx, err := Conn.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	root := tx.Bucket(BucketObjects)
+	if root == nil {
+		return nil
+	}
+	b := root.Bucket([]byte(repo))
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(_, v []byte) error {
+		m := &ObjectMetadata{}
+		if err := json.Unmarshal(v, m); err != nil {
+			return err
+		}
+		fn(m)
+		return nil
+	})
+}
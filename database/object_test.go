@@ -0,0 +1,116 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestObjectMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Conn, err = bolt.Open(filepath.Join(dir, "test.db"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Conn.Close()
+
+	// The object which is downloaded before the upload is recorded (e.g. uploaded before the index exists)
+	if err := RecordObjectDownload("f110/test1", "aaaa", 10); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadObjectMetadata("f110/test1", "aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Uploader != "" || m.UploadedAt.IsZero() == false || m.DownloadCount != 1 {
+		t.Errorf("unexpected metadata: %+v", m)
+	}
+
+	if err := RecordObjectUpload("f110/test1", "aaaa", 10, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	// The first uploader is kept
+	if err := RecordObjectUpload("f110/test1", "aaaa", 10, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	m, err = ReadObjectMetadata("f110/test1", "aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Uploader != "alice" || m.UploadedAt.IsZero() || m.DownloadCount != 1 {
+		t.Errorf("unexpected metadata: %+v", m)
+	}
+
+	if err := RecordObjectUpload("f110/test1", "bbbb", 5, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordObjectUpload("f110/test2", "cccc", 7, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := RecordObjectDownload("f110/test1", "bbbb", 5); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	objects, err := ReadObjectMetadataList("f110/test1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Errorf("unexpected objects: %v", objects)
+	}
+	objects, err = ReadObjectMetadataList("f110/test1", func(m *ObjectMetadata) bool { return m.Uploader == "bob" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].ObjectID != "bbbb" || objects[0].DownloadCount != 50 {
+		t.Errorf("unexpected objects: %v", objects)
+	}
+
+	objects, err = ReadObjectsUploadedBy("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oids := make([]string, 0, len(objects))
+	for _, m := range objects {
+		oids = append(oids, m.Repo+":"+m.ObjectID)
+	}
+	sort.Strings(oids)
+	if len(oids) != 2 || oids[0] != "f110/test1:aaaa" || oids[1] != "f110/test2:cccc" {
+		t.Errorf("unexpected objects: %v", oids)
+	}
+	if objects, err := ReadObjectsUploadedBy("carol"); err != nil || len(objects) != 0 {
+		t.Errorf("unexpected objects: %v %v", objects, err)
+	}
+
+	usage, err := ReadRepositoryUsage("f110/test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Objects != 2 || usage.Size != 15 || usage.DownloadCount != 51 {
+		t.Errorf("unexpected usage: %+v", usage)
+	}
+	usage, err = ReadRepositoryUsage("f110/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Objects != 0 || usage.Size != 0 || usage.DownloadCount != 0 {
+		t.Errorf("unexpected usage: %+v", usage)
+	}
+}
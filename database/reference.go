@@ -0,0 +1,98 @@
+package database
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	BucketObjectReferences = []byte("ObjectReferences")
+)
+
+// AddObjectReference records that repo refers the object in the pool.
+func AddObjectReference(pool, oid, repo string) error {
+	return Conn.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(BucketObjectReferences)
+		if err != nil {
+			return err
+		}
+		p, err := root.CreateBucketIfNotExists([]byte(pool))
+		if err != nil {
+			return err
+		}
+		b, err := p.CreateBucketIfNotExists([]byte(oid))
+		if err != nil {
+			return err
+		}
+		if b.Get([]byte(repo)) != nil {
+			return nil
+		}
+
+		value, err := time.Now().UTC().MarshalText()
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(repo), value)
+	})
+}
+
+// ReadObjectReferences returns the repositories which refer the object in the pool.
+func ReadObjectReferences(pool, oid string) ([]string, error) {
+	tx, err := Conn.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	b := objectReferenceBucket(tx, pool, oid)
+	if b == nil {
+		return nil, nil
+	}
+	repos := make([]string, 0)
+	err = b.ForEach(func(k, _ []byte) error {
+		repos = append(repos, string(k))
+		return nil
+	})
+	return repos, err
+}
+
+// DeleteObjectReference deletes the reference of repo and returns the number of remaining references.
+// The object in the pool can be deleted only when no reference remains.
+func DeleteObjectReference(pool, oid, repo string) (int, error) {
+	remaining := 0
+	err := Conn.Update(func(tx *bolt.Tx) error {
+		b := objectReferenceBucket(tx, pool, oid)
+		if b == nil {
+			return nil
+		}
+		if err := b.Delete([]byte(repo)); err != nil {
+			return err
+		}
+
+		err := b.ForEach(func(_, _ []byte) error {
+			remaining++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if remaining == 0 {
+			return tx.Bucket(BucketObjectReferences).Bucket([]byte(pool)).DeleteBucket([]byte(oid))
+		}
+		return nil
+	})
+	return remaining, err
+}
+
+func objectReferenceBucket(tx *bolt.Tx, pool, oid string) *bolt.Bucket {
+	root := tx.Bucket(BucketObjectReferences)
+	if root == nil {
+		return nil
+	}
+	p := root.Bucket([]byte(pool))
+	if p == nil {
+		return nil
+	}
+	return p.Bucket([]byte(oid))
+}
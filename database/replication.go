@@ -0,0 +1,118 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	BucketReplication = []byte("Replication")
+)
+
+// ReplicationJob is the copy of the object to the replica.
+type ReplicationJob struct {
+	// Replica is the name of the replica which doesn't change when replicas are reordered
+	Replica     string
+	Repo        string
+	ObjectID    string
+	Attempts    int
+	NextAttempt time.Time
+	CreatedAt   time.Time
+}
+
+func (job *ReplicationJob) key() []byte {
+	return []byte(fmt.Sprintf("%s/%s/%s", job.Replica, job.Repo, job.ObjectID))
+}
+
+// EnqueueReplication adds jobs to the queue. The job which is already queued is reset.
+func EnqueueReplication(queue string, jobs ...*ReplicationJob) error {
+	return Conn.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(BucketReplication)
+		if err != nil {
+			return err
+		}
+		b, err := root.CreateBucketIfNotExists([]byte(queue))
+		if err != nil {
+			return err
+		}
+
+		for _, job := range jobs {
+			value, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(job.key(), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReadReplicationJobs returns at most limit jobs which should be attempted by now.
+func ReadReplicationJobs(queue string, now time.Time, limit int) ([]*ReplicationJob, error) {
+	tx, err := Conn.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	jobs := make([]*ReplicationJob, 0)
+	root := tx.Bucket(BucketReplication)
+	if root == nil {
+		return jobs, nil
+	}
+	b := root.Bucket([]byte(queue))
+	if b == nil {
+		return jobs, nil
+	}
+	c := b.Cursor()
+	for k, v := c.First(); k != nil && len(jobs) < limit; k, v = c.Next() {
+		job := &ReplicationJob{}
+		if err := json.Unmarshal(v, job); err != nil {
+			return nil, err
+		}
+		if job.NextAttempt.After(now) {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// UpdateReplicationJob saves the job if the job is still queued.
+func UpdateReplicationJob(queue string, job *ReplicationJob) error {
+	return Conn.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(BucketReplication)
+		if root == nil {
+			return nil
+		}
+		b := root.Bucket([]byte(queue))
+		if b == nil || b.Get(job.key()) == nil {
+			return nil
+		}
+
+		value, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		return b.Put(job.key(), value)
+	})
+}
+
+func DeleteReplicationJob(queue string, job *ReplicationJob) error {
+	return Conn.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(BucketReplication)
+		if root == nil {
+			return nil
+		}
+		b := root.Bucket([]byte(queue))
+		if b == nil {
+			return nil
+		}
+		return b.Delete(job.key())
+	})
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	_ "cloud.google.com/go/storage"
 	_ "github.com/aws/aws-sdk-go/aws"
@@ -12,31 +14,50 @@ import (
 	"github.com/f110/git-lfs-cloud/config"
 	"github.com/f110/git-lfs-cloud/database"
 	"github.com/f110/git-lfs-cloud/lfs"
+	"github.com/f110/git-lfs-cloud/storage"
 )
 
+// openTimeout is the time to wait for the lock of the database file.
+const openTimeout = 5 * time.Second
+
 var (
 	globalConfig config.Config
 )
 
+func usage() int {
+	fmt.Fprintln(os.Stderr, "Usage: git-lfs-cloud [config file]")
+	fmt.Fprintln(os.Stderr, "       git-lfs-cloud rewrap-keys [config file]")
+	fmt.Fprintln(os.Stderr, "       git-lfs-cloud migrate <owner/repo> [config file]")
+	return 1
+}
+
 func run() int {
-	if len(os.Args) != 2 {
-		fmt.Fprintln(os.Stderr, "Usage: git-lfs-cloud [config file]")
-		return 1
+	// The config file is always the last argument
+	if len(os.Args) < 2 {
+		return usage()
+	}
+	var command string
+	var args []string
+	configFile := os.Args[len(os.Args)-1]
+	if len(os.Args) > 2 {
+		command, args = os.Args[1], os.Args[2:len(os.Args)-1]
 	}
 
 	// Read config file
-	conf, err := config.Read(os.Args[1])
+	conf, err := config.Read(configFile)
 	if err != nil {
 		fmt.Fprint(os.Stderr, err)
 		return 1
 	}
 	globalConfig = conf
 
-	github := auth.NewGitHub(globalConfig.GitHub.Token)
-	auth.DefaultClient = github
-
 	// Open database file
-	db, err := bolt.Open(globalConfig.LocalCacheFile, 0644, nil)
+	// The file is locked while lfs server is running, so the commands fail instead of waiting for the server forever
+	db, err := bolt.Open(globalConfig.LocalCacheFile, 0644, &bolt.Options{Timeout: openTimeout})
+	if err == bolt.ErrTimeout {
+		fmt.Fprintf(os.Stderr, "%s is locked by another process. stop lfs server which uses it and retry\n", globalConfig.LocalCacheFile)
+		return 1
+	}
 	if err != nil {
 		fmt.Fprint(os.Stderr, err)
 		return 1
@@ -44,19 +65,127 @@ func run() int {
 	defer db.Close()
 	database.Conn = db
 
+	switch command {
+	case "":
+		return serve()
+	case "rewrap-keys":
+		return rewrapKeys()
+	case "migrate":
+		if len(args) != 1 {
+			return usage()
+		}
+		return migrate(args[0])
+	default:
+		return usage()
+	}
+}
+
+// masterKeyFiles adds the master key files which are used by the storage and its backends to files.
+func masterKeyFiles(conf *config.RepositoryConfig, files map[string]bool) error {
+	for c := conf; c != nil; c = c.Backend {
+		f, err := storage.MasterKeyFile(c)
+		if err != nil {
+			return err
+		}
+		if f != "" {
+			files[f] = true
+		}
+	}
+	return nil
+}
+
+// rewrapKeys wraps data keys of encrypted storages by the current master key.
+func rewrapKeys() int {
+	files := make(map[string]bool)
+	for k, v := range globalConfig.Repositories {
+		if err := masterKeyFiles(v, files); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", k, err)
+			return 1
+		}
+	}
+	for k, v := range globalConfig.Pools {
+		if err := masterKeyFiles(v, files); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", k, err)
+			return 1
+		}
+	}
+
+	for f := range files {
+		n, err := storage.RewrapDataKeys(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", f, err)
+			return 1
+		}
+		fmt.Printf("%s: %d data keys are rewrapped\n", f, n)
+	}
+	return 0
+}
+
+// migrate copies objects of the repository to the storage of migrate_to.
+// The repository is switched to the new storage when lfs server starts after all objects have been copied.
+// lfs server reads the objects missing in the new storage from the old storage until migrate runs again after the switch.
+func migrate(repoName string) int {
+	repoConf, ok := globalConfig.Repositories[repoName]
+	if ok == false {
+		fmt.Fprintf(os.Stderr, "%s is not found\n", repoName)
+		return 1
+	}
+	if repoConf.MigrateTo == nil {
+		fmt.Fprintf(os.Stderr, "%s doesn't have migrate_to\n", repoName)
+		return 1
+	}
+	if repoConf.Pool != "" {
+		fmt.Fprintf(os.Stderr, "%s stores objects in the pool %s\n", repoName, repoConf.Pool)
+		return 1
+	}
+
+	src, err := storage.Open(&globalConfig, repoConf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dstConf := storage.MigrationDestination(repoConf)
+	dst, err := storage.Open(&globalConfig, dstConf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, keySpace := range append([]string{repoName}, repoConf.Aliases...) {
+		m, err := storage.Migrate(context.Background(), src, repoConf.Bucket, dst, dstConf.Bucket, repoName, keySpace, storage.DefaultMigrateConcurrency)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", keySpace, err)
+			return 1
+		}
+		fmt.Printf("%s: %d objects are copied, %d objects already exist\n", keySpace, m.Copied, m.Skipped)
+	}
+	fmt.Printf("%s is switched to the new storage after restarting lfs server. Run migrate again after the switch to stop reading the old storage\n", repoName)
+	return 0
+}
+
+func serve() int {
+	github := auth.NewGitHub(globalConfig.GitHub.Token)
+	auth.DefaultClient = github
+
 	github.CrawlRepositories(globalConfig.Repositories)
 
+	lfsServer, err := lfs.NewServer(&globalConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		auth.SSHServer()
+		auth.SSHServer(lfsServer)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		lfs.ObjectServer(globalConfig.DisableHttps, globalConfig.CertFile, globalConfig.KeyFile, globalConfig.Repositories)
+		lfs.ObjectServer(&globalConfig, lfsServer)
 	}()
 	wg.Wait()
 
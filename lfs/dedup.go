@@ -0,0 +1,113 @@
+package lfs
+
+import (
+	"context"
+	"errors"
+
+	"github.com/f110/git-lfs-cloud/database"
+)
+
+// errNotShared means the object is in the pool, but the user doesn't have access to any repository which refers it.
+var errNotShared = errors.New("object is not shared with the user")
+
+// dedupObject records the reference to the object which is already in the pool of the repository.
+// The reference is recorded only if the user has access to one of the repositories which refer the object,
+// otherwise knowing oid would be enough to read any object in the pool.
+// If the object is not in the pool, dedupObject returns storage.ErrObjectNotExist.
+func (server *Server) dedupObject(ctx context.Context, repoName, username string, o Object) error {
+	repoConf := server.Repositories[repoName]
+	info, err := repoConf.storageEngine.Stat(ctx, repoConf.bucketName, repoName, o.Oid)
+	if err != nil {
+		return err
+	}
+	if info.Size != int64(o.Size) {
+		return errNotShared
+	}
+
+	refs, err := database.ReadObjectReferences(repoConf.pool, o.Oid)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if ref == repoName {
+			return nil
+		}
+	}
+	if isSharedWith(refs, username) == false {
+		return errNotShared
+	}
+	if err := database.AddObjectReference(repoConf.pool, o.Oid, repoName); err != nil {
+		return err
+	}
+	// The deduplicated object is regarded as uploaded because the repository starts to refer it
+	recordUpload(repoName, username, o.Oid, info.Size)
+	return nil
+}
+
+// isSharedWith reports whether the user has access to one of the repositories.
+func isSharedWith(refs []string, username string) bool {
+	for _, ref := range refs {
+		users, err := database.ReadRepositoryUsers(ref)
+		if err != nil {
+			continue
+		}
+		for _, u := range users {
+			if u == username {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimReference records the reference to the object which is verified by the repository in the pool.
+// The object is referred only if it is shared with the user as well as dedupObject,
+// otherwise verifying oid and size would be enough to read any object in the pool.
+func (server *Server) claimReference(repoName, username, oid string) error {
+	pool := server.Repositories[repoName].pool
+	if pool == "" {
+		return nil
+	}
+	refs, err := database.ReadObjectReferences(pool, oid)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if ref == repoName {
+			return nil
+		}
+	}
+	if isSharedWith(refs, username) == false {
+		return errNotShared
+	}
+	return database.AddObjectReference(pool, oid, repoName)
+}
+
+// addReference records the reference to the uploaded object if the repository is in the pool.
+func (server *Server) addReference(repoName, oid string) error {
+	pool := server.Repositories[repoName].pool
+	if pool == "" {
+		return nil
+	}
+	return database.AddObjectReference(pool, oid, repoName)
+}
+
+// isReferenced reports whether the repository or its aliases refer the object in the pool.
+func (server *Server) isReferenced(repoName, oid string) (bool, error) {
+	repoConf := server.Repositories[repoName]
+	refs, err := database.ReadObjectReferences(repoConf.pool, oid)
+	if err != nil {
+		return false, err
+	}
+	for _, ref := range refs {
+		if ref == repoName {
+			return true, nil
+		}
+		for _, alias := range repoConf.aliases {
+			if ref == alias {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
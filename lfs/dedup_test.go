@@ -0,0 +1,171 @@
+package lfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/database"
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+func TestDeduplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var handler http.Handler
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req)
+	}))
+	defer s.Close()
+	serv, err := NewServer(&config.Config{
+		URL:   s.URL,
+		Pools: map[string]*config.RepositoryConfig{"shared": {Storage: "local", SigningKey: "test", Drivers: map[string]config.DriverConfig{"local": {"path": dir}}}},
+		Repositories: map[string]*config.RepositoryConfig{
+			"f110/test1":  {Owner: "f110", Repo: "test1", Pool: "shared"},
+			"f110/pool2":  {Owner: "f110", Repo: "pool2", Pool: "shared"},
+			"other/pool3": {Owner: "other", Repo: "pool3", Pool: "shared"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler = serv.ServeMux()
+	database.SaveRepositoryUsers("f110/pool2", []string{"test-user"})
+	database.SaveRepositoryUsers("other/pool3", []string{"stranger"})
+
+	content := []byte("shared base texture")
+	h := sha256.Sum256(content)
+	oid := hex.EncodeToString(h[:])
+	objects := []Object{{Oid: oid, Size: len(content)}}
+
+	t.Run("upload", func(t *testing.T) {
+		batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{Operation: OperationUpload, Objects: objects})
+		a := batchRes.Objects[0].Actions
+		if a == nil || a.Upload == nil {
+			t.Fatalf("unexpected actions: %v", a)
+		}
+		// The object in the pool is never uploaded to the storage directly
+		if a.Upload.Href != s.URL+"/f110/test1.git/info/lfs/objects/"+oid {
+			t.Fatalf("upload is not proxied: %s", a.Upload.Href)
+		}
+		res := doAction(t, http.MethodPut, a.Upload.Href, a.Upload.Header, []byte("corrupted base texture"))
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("corrupted object is accepted: %d", res.StatusCode)
+		}
+		res = doAction(t, http.MethodPut, a.Upload.Href, a.Upload.Header, content)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+	})
+
+	t.Run("authorized", func(t *testing.T) {
+		batchRes := doBatchRequest(t, s.URL, "f110/pool2", "for-test", &BatchRequest{Operation: OperationUpload, Objects: objects})
+		if batchRes.Objects[0].Actions != nil || batchRes.Objects[0].Error != nil {
+			t.Fatalf("upload of the shared object is not skipped: %v", batchRes.Objects[0])
+		}
+
+		batchRes = doBatchRequest(t, s.URL, "f110/pool2", "for-test", &BatchRequest{Operation: OperationDownload, Objects: objects})
+		if batchRes.Objects[0].Error != nil {
+			t.Fatalf("unexpected error: %s", batchRes.Objects[0].Error.Message)
+		}
+		res := doAction(t, http.MethodGet, batchRes.Objects[0].Actions.Download.Href, nil, nil)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || bytes.Equal(body, content) == false {
+			t.Errorf("unexpected response: %d %s", res.StatusCode, body)
+		}
+	})
+
+	t.Run("verify_without_upload", func(t *testing.T) {
+		body, _ := json.Marshal(objects[0])
+		res := doAction(t, http.MethodPost, s.URL+"/other/pool3.git/info/lfs/verify", map[string]string{
+			"Content-Type":  ContentType,
+			"Authorization": "Bearer for-test-stranger",
+		}, body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("the object which is not uploaded by the repository is verified: %d", res.StatusCode)
+		}
+
+		batchRes := doBatchRequest(t, s.URL, "other/pool3", "for-test-stranger", &BatchRequest{Operation: OperationDownload, Objects: objects})
+		if batchRes.Objects[0].Error == nil || batchRes.Objects[0].Error.Code != ErrorCodeNotExist {
+			t.Fatalf("the object is referred by verify: %v", batchRes.Objects[0])
+		}
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		batchRes := doBatchRequest(t, s.URL, "other/pool3", "for-test-stranger", &BatchRequest{Operation: OperationDownload, Objects: objects})
+		if batchRes.Objects[0].Error == nil || batchRes.Objects[0].Error.Code != ErrorCodeNotExist {
+			t.Fatalf("the object which is not referred is downloadable: %v", batchRes.Objects[0])
+		}
+
+		batchRes = doBatchRequest(t, s.URL, "other/pool3", "for-test-stranger", &BatchRequest{Operation: OperationUpload, Objects: objects})
+		upload := batchRes.Objects[0].Actions.Upload
+		if strings.HasPrefix(upload.Href, s.URL+"/other/pool3.git/info/lfs/objects/") == false {
+			t.Fatalf("the upload is not proved by lfs server: %s", upload.Href)
+		}
+		res := doAction(t, http.MethodPut, upload.Href, upload.Header, []byte("corrupted content!!"))
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("corrupted content is accepted: %d", res.StatusCode)
+		}
+		res = doAction(t, http.MethodPut, upload.Href, upload.Header, content)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+
+		batchRes = doBatchRequest(t, s.URL, "other/pool3", "for-test-stranger", &BatchRequest{Operation: OperationDownload, Objects: objects})
+		if batchRes.Objects[0].Error != nil {
+			t.Errorf("unexpected error: %s", batchRes.Objects[0].Error.Message)
+		}
+	})
+
+	t.Run("references", func(t *testing.T) {
+		refs, err := database.ReadObjectReferences("shared", oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refs) != 3 {
+			t.Fatalf("unexpected references: %v", refs)
+		}
+		for i, repo := range []string{"f110/test1", "f110/pool2", "other/pool3"} {
+			remaining, err := database.DeleteObjectReference("shared", oid, repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remaining != 2-i {
+				t.Errorf("unexpected remaining references: %d", remaining)
+			}
+		}
+	})
+
+	t.Run("global_scope_outside_pool", func(t *testing.T) {
+		_, err := NewServer(&config.Config{Repositories: map[string]*config.RepositoryConfig{
+			"f110/test1": {Owner: "f110", Repo: "test1", Storage: "nop", KeyLayout: &config.KeyLayout{Scope: storage.KeyScopeGlobal}},
+		}})
+		if err == nil {
+			t.Error("global key scope of the repository is accepted")
+		}
+
+		_, err = NewServer(&config.Config{Repositories: map[string]*config.RepositoryConfig{
+			"f110/test1": {Owner: "f110", Repo: "test1", Storage: "nop", MigrateTo: &config.RepositoryConfig{Storage: "nop", KeyLayout: &config.KeyLayout{Scope: storage.KeyScopeGlobal}}},
+		}})
+		if err == nil {
+			t.Error("global key scope of the migration destination is accepted")
+		}
+	})
+}
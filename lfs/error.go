@@ -0,0 +1,65 @@
+package lfs
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	DocumentationURL = "https://github.com/f110/git-lfs-cloud"
+	RequestIDHeader  = "X-Request-Id"
+)
+
+var (
+	errUnauthorized = errors.New("credentials needed")
+	errForbidden    = errors.New("forbidden")
+)
+
+type ErrorResponse struct {
+	Message          string `json:"message"`
+	DocumentationURL string `json:"documentation_url,omitempty"`
+	RequestID        string `json:"request_id,omitempty"`
+}
+
+type requestIDKey struct{}
+
+// withRequestID assigns the id to each request. The id is returned in the error response and response header.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+// newRequestID returns the random id. If the random source fails, the current time is used instead
+// because the id is only used for looking up logs.
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Print(err)
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%x", buf)
+}
+
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func writeError(w http.ResponseWriter, req *http.Request, status int, message string) {
+	if status == http.StatusUnauthorized {
+		// The session token which is issued by git-lfs-authenticate is the only accepted credential
+		w.Header().Set("LFS-Authenticate", `Bearer realm="Git LFS"`)
+	}
+	writeJSON(w, status, &ErrorResponse{Message: message, DocumentationURL: DocumentationURL, RequestID: requestID(req)})
+}
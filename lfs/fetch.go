@@ -0,0 +1,95 @@
+package lfs
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+// errFetching means the object is being copied into the storage of the repository in the background.
+// The object is served through lfs server, which waits for the copy, until the copy completes.
+var errFetching = errors.New("object is being fetched")
+
+// objectFetch is the copy of the object into the storage. Concurrent requests of the object wait for it.
+type objectFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// isFetching reports whether the copy of the object is in progress.
+func (server *Server) isFetching(repoName, oid string) bool {
+	server.fetchMu.Lock()
+	defer server.fetchMu.Unlock()
+	_, ok := server.fetches[repoName+"/"+oid]
+	return ok
+}
+
+// startFetch runs fn in the background unless the copy of the object is in progress.
+// fn is not bound to the request, so the copy is not canceled when the batch request times out.
+// Instead the copy is canceled after DefaultFetchTimeout so that a stalled source doesn't block the object forever.
+func (server *Server) startFetch(repoName, oid string, fn func(ctx context.Context) error) {
+	key := repoName + "/" + oid
+	server.fetchMu.Lock()
+	defer server.fetchMu.Unlock()
+	if _, ok := server.fetches[key]; ok {
+		return
+	}
+	f := &objectFetch{done: make(chan struct{})}
+	server.fetches[key] = f
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultFetchTimeout)
+		f.err = fn(ctx)
+		cancel()
+		if f.err != nil {
+			log.Print(f.err)
+		}
+		server.fetchMu.Lock()
+		delete(server.fetches, key)
+		server.fetchMu.Unlock()
+		close(f.done)
+	}()
+}
+
+// waitFetch waits for the copy of the object if the copy is in progress.
+func (server *Server) waitFetch(ctx context.Context, repoName, oid string) error {
+	server.fetchMu.Lock()
+	f, ok := server.fetches[repoName+"/"+oid]
+	server.fetchMu.Unlock()
+	if ok == false {
+		return nil
+	}
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchMigrationSource starts to copy the object from the storage which the repository has been migrated from.
+// If the source doesn't have the object either, fetchMigrationSource returns storage.ErrObjectNotExist.
+func (server *Server) fetchMigrationSource(ctx context.Context, repoName, oid string, size int64) (*storage.ObjectInfo, error) {
+	if server.isFetching(repoName, oid) {
+		return &storage.ObjectInfo{Size: size}, nil
+	}
+	repoConf := server.Repositories[repoName]
+	for _, keySpace := range append([]string{repoName}, repoConf.aliases...) {
+		info, err := repoConf.migrateSource.Stat(ctx, repoConf.migrateBucket, keySpace, oid)
+		if err == storage.ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keySpace := keySpace
+		server.startFetch(repoName, oid, func(ctx context.Context) error {
+			o := &storage.ListedObject{ObjectID: oid, Size: info.Size}
+			_, err := storage.MigrateObject(ctx, repoConf.migrateSource, repoConf.migrateBucket, repoConf.storageEngine, repoConf.bucketName, keySpace, o)
+			return err
+		})
+		return info, nil
+	}
+	return nil, storage.ErrObjectNotExist
+}
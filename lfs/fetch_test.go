@@ -0,0 +1,106 @@
+package lfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/database"
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+func TestMigrationSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The checkpoint of the migration is kept in the database, so the test uses its own database to run repeatedly
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	conn := database.Conn
+	database.Conn = db
+	defer func() { database.Conn = conn }()
+
+	repoConf := &config.RepositoryConfig{
+		Owner:      "f110",
+		Repo:       "migrated",
+		Storage:    "local",
+		SigningKey: "test",
+		Drivers:    map[string]config.DriverConfig{"local": {"path": filepath.Join(dir, "src")}},
+		MigrateTo:  &config.RepositoryConfig{Storage: "local", Drivers: map[string]config.DriverConfig{"local": {"path": filepath.Join(dir, "dst")}}},
+	}
+	src, err := storage.Open(&config.Config{}, repoConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := storage.Open(&config.Config{}, storage.MigrationDestination(repoConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	put := func(content string) string {
+		h := sha256.Sum256([]byte(content))
+		oid := hex.EncodeToString(h[:])
+		w, err := src.PutObject(ctx, "", "f110/migrated", oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return oid
+	}
+	migrate := func() {
+		if _, err := storage.Migrate(ctx, src, "", dst, "", "f110/migrated", "f110/migrated", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newServer := func() *Server {
+		serv, err := NewServer(&config.Config{Repositories: map[string]*config.RepositoryConfig{"f110/migrated": repoConf}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serv
+	}
+
+	put("copied by migration")
+	migrate()
+	// The object is uploaded to the source after the last pass
+	oid := put("uploaded after migration")
+
+	serv := newServer()
+	_, info, err := serv.locateObject(ctx, "f110/migrated", oid, 24)
+	if err != errFetching || info.Size != 24 {
+		t.Fatalf("the object in the source is not fetched: %v %v", info, err)
+	}
+	_, info, err = serv.waitObject(ctx, "f110/migrated", oid)
+	if err != nil || info.Size != 24 {
+		t.Fatalf("the object in the source is not fetched: %v %v", info, err)
+	}
+	if _, err := dst.Stat(ctx, "", "f110/migrated", oid); err != nil {
+		t.Errorf("the object is not copied to the destination: %v", err)
+	}
+	if _, _, err := serv.locateObject(ctx, "f110/migrated", "1111111111111111111111111111111111111111111111111111111111111111", 1); err != storage.ErrObjectNotExist {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// The source is not read after the pass which started after switching the storage
+	migrate()
+	if serv := newServer(); serv.Repositories["f110/migrated"].migrateSource != nil {
+		t.Error("the source is read after the catch-up pass")
+	}
+}
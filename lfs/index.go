@@ -0,0 +1,23 @@
+package lfs
+
+import (
+	"log"
+
+	"github.com/f110/git-lfs-cloud/database"
+)
+
+// recordUpload adds the verified object to the object index.
+// The failure is only logged because the object has been stored already.
+func recordUpload(repoName, username, oid string, size int64) {
+	if err := database.RecordObjectUpload(repoName, oid, size, username); err != nil {
+		log.Print(err)
+	}
+}
+
+// recordDownload counts the download of the object in the object index.
+// The download is counted when the download action is issued, whether the object is transferred through lfs server or not.
+func recordDownload(repoName, oid string, size int64) {
+	if err := database.RecordObjectDownload(repoName, oid, size); err != nil {
+		log.Print(err)
+	}
+}
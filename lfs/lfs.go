@@ -1,10 +1,13 @@
 package lfs
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/f110/git-lfs-cloud/config"
@@ -23,6 +26,7 @@ const (
 	ErrorCodeTooManyRequest               = 429
 	ErrorCodeDiskFull                     = 507
 	ErrorCodeBandwidthLimit               = 509
+	ErrorCodeInternalServerError          = 500
 )
 
 const (
@@ -30,11 +34,21 @@ const (
 	OperationUpload   = "upload"
 )
 
+const (
+	DefaultBatchConcurrency = 8
+	DefaultBatchTimeout     = 30 * time.Second
+	DefaultMaxBatchSize     = 1000
+	// DefaultFetchTimeout bounds the copy of the object in the background, including the request to the upstream
+	DefaultFetchTimeout = 1 * time.Hour
+)
+
 type BatchRequest struct {
 	Operation string            `json:"operation"`
 	Transfers []string          `json:"transfers"`
 	Refs      map[string]string `json:"refs"`
 	Objects   []Object          `json:"objects"`
+	// ssh is true if the request is sent by git-lfs-transfer protocol
+	ssh bool
 }
 
 type BatchResponse struct {
@@ -43,17 +57,21 @@ type BatchResponse struct {
 }
 
 type Object struct {
-	Oid          string `json:"oid"`
-	Size         int    `json:"size"`
-	Autheticated bool   `json:"authenticated,omitempty"`
-	Actions      Action `json:"actions,omitempty"`
-	Erros        Error  `json:"errors,omitempty"`
+	Oid          string  `json:"oid"`
+	Size         int     `json:"size"`
+	Autheticated bool    `json:"authenticated,omitempty"`
+	Actions      *Action `json:"actions,omitempty"`
+	Error        *Error  `json:"error,omitempty"`
 }
 
 type Action struct {
 	Download *Download `json:"download,omitempty"`
 	Upload   *Upload   `json:"upload,omitempty"`
 	Verify   *Verify   `json:"verify,omitempty"`
+	// Parts, Commit and Abort are used by multipart-basic transfer
+	Parts  []*Part `json:"parts,omitempty"`
+	Commit *Commit `json:"commit,omitempty"`
+	Abort  *Abort  `json:"abort,omitempty"`
 }
 
 type Download struct {
@@ -72,149 +90,525 @@ type Error struct {
 }
 
 type Server struct {
-	Repositories map[string]repositoryConfig
+	Repositories     map[string]repositoryConfig
+	aliases          map[string]string
+	baseURL          string
+	batchConcurrency int
+	batchTimeout     time.Duration
+	maxBatchSize     int
+
+	fetchMu sync.Mutex
+	fetches map[string]*objectFetch
 }
 
 type repositoryConfig struct {
-	storageEngine storage.Storage
-	bucketName    string
+	storageEngine      storage.Storage
+	bucketName         string
+	verifyContent      bool
+	urlExpire          time.Duration
+	multipartThreshold int64
+	proxy              bool
+	aliases            []string
+	pool               string
+	upstream           *config.UpstreamConfig
+	// migrateSource is the storage which the repository has been migrated from.
+	// It is not nil until the objects uploaded before switching the storage have been copied.
+	migrateSource storage.Storage
+	migrateBucket string
+	admins        []string
 }
 
-func NewServer(repositories map[string]*config.RepositoryConfig) *Server {
+// expiration returns expires_in (seconds) and expires_at (RFC3339) of the URL which is signed now.
+func (c repositoryConfig) expiration() (int64, string) {
+	return int64(c.urlExpire / time.Second), time.Now().Add(c.urlExpire).UTC().Format(time.RFC3339)
+}
+
+func NewServer(conf *config.Config) (*Server, error) {
+	pools := make(map[string]storage.Storage)
+	for name, v := range conf.Pools {
+		poolConf := *v
+		poolConf.Owner, poolConf.Repo = "pools", name
+		if poolConf.KeyLayout == nil {
+			poolConf.KeyLayout = &config.KeyLayout{Scope: storage.KeyScopeGlobal}
+		}
+		if poolConf.KeyLayout.Scope != storage.KeyScopeGlobal {
+			return nil, fmt.Errorf("lfs: pool %s has to use the global key scope", name)
+		}
+		engine, err := storage.Open(conf, &poolConf)
+		if err != nil {
+			return nil, err
+		}
+		pools[name] = engine
+	}
+
 	reposConfig := make(map[string]repositoryConfig)
-	for _, v := range repositories {
+	aliases := make(map[string]string)
+	for _, v := range conf.Repositories {
+		for _, alias := range v.Aliases {
+			if _, ok := conf.Repositories[alias]; ok {
+				return nil, fmt.Errorf("lfs: alias %s of %s/%s is used by another repository", alias, v.Owner, v.Repo)
+			}
+			if name, ok := aliases[alias]; ok {
+				return nil, fmt.Errorf("lfs: alias %s is used by both %s and %s/%s", alias, name, v.Owner, v.Repo)
+			}
+			aliases[alias] = v.Owner + "/" + v.Repo
+		}
+		if v.Upstream != nil && v.Upstream.URL == "" {
+			return nil, fmt.Errorf("lfs: url of the upstream of %s/%s is required", v.Owner, v.Repo)
+		}
+		if globalKeyScope(v) {
+			return nil, fmt.Errorf("lfs: %s/%s can't use the global key scope. use the pool to share objects", v.Owner, v.Repo)
+		}
+		storageConf := v
 		var engine storage.Storage
-		switch v.Storage {
-		case "google":
-			engine = storage.NewCloudStorage(v.AccessID, v.CredentialFile)
-		case "s3":
-			engine = storage.NewAmazonS3(v.Region)
-		case "nop":
-			engine = &storage.Nop{}
+		var migrateSource storage.Storage
+		var migrateBucket string
+		if v.Pool != "" {
+			if _, ok := pools[v.Pool]; ok == false {
+				return nil, fmt.Errorf("lfs: pool %s of %s/%s is not defined", v.Pool, v.Owner, v.Repo)
+			}
+			storageConf = conf.Pools[v.Pool]
+			engine = pools[v.Pool]
+		} else {
+			migrated, err := storage.Migrated(v)
+			if err != nil {
+				return nil, err
+			}
+			if migrated {
+				// The objects uploaded to the source after the last pass of the migration are read from the source
+				fallback, err := storage.SwitchMigration(v)
+				if err != nil {
+					return nil, err
+				}
+				if fallback {
+					migrateSource, err = storage.Open(conf, v)
+					if err != nil {
+						return nil, err
+					}
+					migrateBucket = v.Bucket
+				}
+				storageConf = storage.MigrationDestination(v)
+			}
+			engine, err = storage.Open(conf, storageConf)
+			if err != nil {
+				return nil, err
+			}
+		}
+		urlExpire := storageConf.URLExpire.Duration
+		if urlExpire <= 0 {
+			urlExpire = storage.URLExpire
+		}
+		multipartThreshold := v.MultipartThreshold
+		if multipartThreshold <= 0 {
+			multipartThreshold = DefaultMultipartThreshold
+		}
+		reposConfig[v.Owner+"/"+v.Repo] = repositoryConfig{
+			storageEngine:      engine,
+			bucketName:         storageConf.Bucket,
+			verifyContent:      v.VerifyContent,
+			urlExpire:          urlExpire,
+			multipartThreshold: multipartThreshold,
+			proxy:              v.Mode == ModeProxy,
+			aliases:            v.Aliases,
+			pool:               v.Pool,
+			upstream:           v.Upstream,
+			migrateSource:      migrateSource,
+			migrateBucket:      migrateBucket,
+			admins:             v.Admins,
+		}
+	}
+	server := &Server{
+		Repositories:     reposConfig,
+		aliases:          aliases,
+		baseURL:          conf.BaseURL(),
+		batchConcurrency: conf.BatchConcurrency,
+		batchTimeout:     conf.BatchTimeout.Duration,
+		maxBatchSize:     conf.MaxBatchSize,
+		fetches:          make(map[string]*objectFetch),
+	}
+	if server.batchConcurrency <= 0 {
+		server.batchConcurrency = DefaultBatchConcurrency
+	}
+	if server.batchTimeout <= 0 {
+		server.batchTimeout = DefaultBatchTimeout
+	}
+	if server.maxBatchSize <= 0 {
+		server.maxBatchSize = DefaultMaxBatchSize
+	}
+	return server, nil
+}
+
+// globalKeyScope reports whether the storage of the repository, including backends, replicas and the migration destination, uses the global key scope.
+// The global key is shared by repositories, so it is allowed only in the pool which checks the references of objects.
+func globalKeyScope(repoConf *config.RepositoryConfig) bool {
+	if repoConf == nil {
+		return false
+	}
+	if repoConf.KeyLayout != nil && repoConf.KeyLayout.Scope == storage.KeyScopeGlobal {
+		return true
+	}
+	for _, v := range repoConf.Replicas {
+		if globalKeyScope(v) {
+			return true
 		}
-		reposConfig[v.Owner+"/"+v.Repo] = repositoryConfig{storageEngine: engine, bucketName: v.Bucket}
 	}
-	return &Server{Repositories: reposConfig}
+	return globalKeyScope(repoConf.Backend) || globalKeyScope(repoConf.MigrateTo)
 }
 
-func (server *Server) batchHandler(w http.ResponseWriter, req *http.Request) {
-	splitedPath := strings.Split(req.URL.EscapedPath(), "/")[1:]
-	repoName := ""
-	repositoryNameNotFound := true
-	for _, v := range splitedPath {
+func splitRepositoryPath(p string) (repoName string, rest string, ok bool) {
+	splitedPath := strings.Split(p, "/")[1:]
+	for i, v := range splitedPath {
 		if strings.Index(v, ".git") > 0 {
-			repoName += v
-			repositoryNameNotFound = false
-			break
+			repoName += v[:strings.Index(v, ".git")]
+			return repoName, strings.Join(splitedPath[i+1:], "/"), true
 		}
 		repoName += v + "/"
 	}
-	if repositoryNameNotFound {
-		return
-	}
-	repoName = repoName[:strings.Index(repoName, ".git")]
+	return "", "", false
+}
 
+func (server *Server) authenticate(req *http.Request, repoName string) (string, error) {
 	authHeader := req.Header.Get("Authorization")
 	if len(authHeader) == 0 {
-		return
+		return "", errUnauthorized
+	}
+	s := strings.Split(authHeader, " ")
+	if len(s) != 2 {
+		return "", errUnauthorized
 	}
-	id := strings.Split(authHeader, " ")[1]
-	sess, err := FindSession(id)
+	sess, err := FindSession(s[1])
 	if err != nil {
-		return
+		return "", errUnauthorized
 	}
 	username := sess.Username
 
 	users, err := database.ReadRepositoryUsers(repoName)
 	if err != nil {
-		return
+		return "", errForbidden
 	}
-	authenticated := false
 	for _, u := range users {
 		if u == username {
-			authenticated = true
-			break
+			return username, nil
 		}
 	}
-	if authenticated == false {
+	return "", errForbidden
+}
+
+func (server *Server) handler(w http.ResponseWriter, req *http.Request) {
+	repoName, p, ok := splitRepositoryPath(req.URL.EscapedPath())
+	if ok == false {
+		writeError(w, req, http.StatusNotFound, "not found")
+		return
+	}
+	if _, ok := server.Repositories[repoName]; ok == false {
+		writeError(w, req, http.StatusNotFound, "repository not found")
+		return
+	}
+	username, err := server.authenticate(req, repoName)
+	switch err {
+	case nil:
+	case errUnauthorized:
+		writeError(w, req, http.StatusUnauthorized, "credentials needed")
+		return
+	default:
+		writeError(w, req, http.StatusForbidden, "you don't have permission to access "+repoName)
 		return
 	}
 
+	switch {
+	case p == "info/lfs/objects/batch" && req.Method == http.MethodPost:
+		server.batchHandler(w, req, repoName, username)
+	case p == "info/lfs/verify" && req.Method == http.MethodPost:
+		server.verifyHandler(w, req, repoName, username)
+	case strings.HasPrefix(p, "info/lfs/objects/") && req.Method == http.MethodGet:
+		server.proxyDownloadHandler(w, req, repoName, strings.TrimPrefix(p, "info/lfs/objects/"))
+	case strings.HasPrefix(p, "info/lfs/objects/") && req.Method == http.MethodPut:
+		server.proxyUploadHandler(w, req, repoName, username, strings.TrimPrefix(p, "info/lfs/objects/"))
+	case p == "info/lfs/locks" && req.Method == http.MethodGet:
+		server.listLocksHandler(w, req, repoName, username)
+	case p == "info/lfs/locks" && req.Method == http.MethodPost:
+		server.createLockHandler(w, req, repoName, username)
+	case p == "info/lfs/locks/verify" && req.Method == http.MethodPost:
+		server.verifyLocksHandler(w, req, repoName, username)
+	case strings.HasPrefix(p, "info/lfs/multipart/") && strings.HasSuffix(p, "/commit") && req.Method == http.MethodPost:
+		oid := strings.TrimSuffix(strings.TrimPrefix(p, "info/lfs/multipart/"), "/commit")
+		server.commitHandler(w, req, repoName, oid)
+	case strings.HasPrefix(p, "info/lfs/multipart/") && strings.HasSuffix(p, "/abort") && req.Method == http.MethodPost:
+		oid := strings.TrimSuffix(strings.TrimPrefix(p, "info/lfs/multipart/"), "/abort")
+		server.abortHandler(w, req, repoName, oid)
+	case strings.HasPrefix(p, "info/lfs/locks/") && strings.HasSuffix(p, "/unlock") && req.Method == http.MethodPost:
+		id := strings.TrimSuffix(strings.TrimPrefix(p, "info/lfs/locks/"), "/unlock")
+		server.unlockHandler(w, req, repoName, username, id)
+	default:
+		writeError(w, req, http.StatusNotFound, "not found")
+	}
+}
+
+func (server *Server) batchHandler(w http.ResponseWriter, req *http.Request, repoName, username string) {
 	var batchReq BatchRequest
 	var batchRes BatchResponse
-	err = json.NewDecoder(req.Body).Decode(&batchReq)
+	err := json.NewDecoder(req.Body).Decode(&batchReq)
 	if err != nil {
+		writeError(w, req, http.StatusUnprocessableEntity, "invalid request body")
+		return
+	}
+	if batchReq.Operation != OperationDownload && batchReq.Operation != OperationUpload {
+		writeError(w, req, http.StatusUnprocessableEntity, "unknown operation: "+batchReq.Operation)
 		return
 	}
-	resObj := make([]Object, 0, len(batchReq.Objects))
-	switch batchReq.Operation {
-	case OperationDownload:
-		for _, o := range batchReq.Objects {
-			u := server.operationDownload(repoName, o.Oid)
-			resObj = append(resObj, Object{
-				Oid:          o.Oid,
-				Size:         o.Size,
-				Autheticated: true,
-				Actions: Action{
-					Download: &Download{Href: u, ExpiresIn: time.Now().Add(5 * time.Minute).Unix(), Header: map[string]string{"Content-Type": "application/octet-stream"}},
-				},
-			})
-		}
-	case OperationUpload:
-		for _, o := range batchReq.Objects {
-			u := server.operationUpload(repoName, o.Oid)
-			var a Action
-			if u != "" {
-				a = Action{Upload: &Upload{Href: u, ExpiresIn: time.Now().Add(5 * time.Minute).Unix()}}
+	if len(batchReq.Objects) > server.maxBatchSize {
+		writeError(w, req, http.StatusRequestEntityTooLarge, fmt.Sprintf("too many objects. the maximum is %d", server.maxBatchSize))
+		return
+	}
+
+	transfer, adapter := server.selectTransfer(repoName, &batchReq)
+	if adapter == nil {
+		writeError(w, req, http.StatusUnprocessableEntity, "no supported transfer adapter")
+		return
+	}
+	batchRes.Transfer = transfer
+	repoConf := server.Repositories[repoName]
+
+	ctx, cancel := context.WithTimeout(req.Context(), server.batchTimeout)
+	defer cancel()
+	batchRes.Objects = server.processObjects(ctx, batchReq.Objects, func(ctx context.Context, o Object) Object {
+		if o.Oid == "" || o.Size < 0 {
+			return Object{Oid: o.Oid, Size: o.Size, Error: &Error{Code: ErrorCodeValidation, Message: "invalid object"}}
+		}
+		if batchReq.Operation == OperationUpload && repoConf.pool != "" {
+			switch err := server.dedupObject(ctx, repoName, username, o); err {
+			case nil:
+				return Object{Oid: o.Oid, Size: o.Size, Autheticated: true}
+			case storage.ErrObjectNotExist, errNotShared:
+				// The object is uploaded through lfs server which hashes the content before storing it at the key shared by the pool.
+				// The client which doesn't share the object also proves the possession of the content by uploading it.
+				return server.proxyAction(repoName, OperationUpload, o, req.Header.Get("Authorization"))
+			default:
+				log.Print(err)
+				return Object{Oid: o.Oid, Size: o.Size, Error: objectError(err)}
 			}
-			resObj = append(resObj, Object{
-				Oid:          o.Oid,
-				Size:         o.Size,
-				Autheticated: true,
-				Actions:      a,
-			})
 		}
-	}
-	batchRes.Objects = resObj
 
-	w.Header().Set("Content-Type", ContentType)
-	enc := json.NewEncoder(w)
-	enc.SetEscapeHTML(false)
-	err = enc.Encode(batchRes)
-	if err != nil {
-		log.Print(err)
+		return adapter.Object(ctx, server, repoName, batchReq.Operation, o, req.Header.Get("Authorization"))
+	})
+	if ctx.Err() == context.DeadlineExceeded {
+		writeError(w, req, http.StatusServiceUnavailable, "batch request timed out")
 		return
 	}
+
+	writeJSON(w, http.StatusOK, batchRes)
+}
+
+// processObjects applies fn to each object by the bounded number of workers.
+// The returned objects are in the same order as objects.
+func (server *Server) processObjects(ctx context.Context, objects []Object, fn func(context.Context, Object) Object) []Object {
+	res := make([]Object, len(objects))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < server.batchConcurrency && i < len(objects); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				res[i] = fn(ctx, objects[i])
+			}
+		}()
+	}
+	for i := range objects {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	return res
+}
+
+// objectError converts the error of storage to the error of each object.
+func objectError(err error) *Error {
+	switch err {
+	case storage.ErrObjectNotExist:
+		return &Error{Code: ErrorCodeNotExist, Message: "object does not exist"}
+	case storage.ErrInvalidObjectID:
+		return &Error{Code: ErrorCodeValidation, Message: "invalid object id"}
+	default:
+		return &Error{Code: ErrorCodeInternalServerError, Message: "internal server error"}
+	}
+}
+
+// locateObject returns the name of the key space which has the object.
+// If the object is not found in the repository, the aliases of the repository are searched.
+// If the object is not found anywhere, the object is fetched from the storage which the repository has been migrated from
+// or the upstream in the background, and errFetching is returned.
+func (server *Server) locateObject(ctx context.Context, repoName, oid string, size int64) (string, *storage.ObjectInfo, error) {
+	keyRepo, info, err := server.locateStoredObject(ctx, repoName, oid)
+	if err != storage.ErrObjectNotExist {
+		return keyRepo, info, err
+	}
+	repoConf := server.Repositories[repoName]
+	if repoConf.migrateSource != nil {
+		info, err := server.fetchMigrationSource(ctx, repoName, oid, size)
+		if err == nil {
+			return repoName, info, errFetching
+		}
+		if err != storage.ErrObjectNotExist {
+			return repoName, nil, err
+		}
+	}
+	if repoConf.upstream != nil {
+		if err := server.fetchUpstream(ctx, repoName, oid, size); err != nil {
+			return repoName, nil, err
+		}
+		return repoName, &storage.ObjectInfo{Size: size}, errFetching
+	}
+	return keyRepo, info, err
 }
 
-func (server *Server) operationDownload(repoName, objectID string) string {
+// waitObject is locateObject which waits for the object to be fetched.
+// The size of the object is not known, so the object should have been located by the batch request first.
+func (server *Server) waitObject(ctx context.Context, repoName, oid string) (string, *storage.ObjectInfo, error) {
+	if err := server.waitFetch(ctx, repoName, oid); err != nil {
+		return repoName, nil, err
+	}
+	keyRepo, info, err := server.locateObject(ctx, repoName, oid, 0)
+	if err == errFetching {
+		if err := server.waitFetch(ctx, repoName, oid); err != nil {
+			return repoName, nil, err
+		}
+		return server.locateStoredObject(ctx, repoName, oid)
+	}
+	return keyRepo, info, err
+}
+
+func (server *Server) locateStoredObject(ctx context.Context, repoName, oid string) (string, *storage.ObjectInfo, error) {
 	repoConf := server.Repositories[repoName]
-	u, err := repoConf.storageEngine.Get(repoConf.bucketName, repoName, objectID)
+	if repoConf.pool != "" {
+		// The object in the pool is visible only from the repositories which refer it
+		ok, err := server.isReferenced(repoName, oid)
+		if err != nil {
+			return repoName, nil, err
+		}
+		if ok == false {
+			return repoName, nil, storage.ErrObjectNotExist
+		}
+	}
+	info, err := repoConf.storageEngine.Stat(ctx, repoConf.bucketName, repoName, oid)
+	if err != storage.ErrObjectNotExist {
+		return repoName, info, err
+	}
+	for _, alias := range repoConf.aliases {
+		info, err := repoConf.storageEngine.Stat(ctx, repoConf.bucketName, alias, oid)
+		if err != storage.ErrObjectNotExist {
+			return alias, info, err
+		}
+	}
+	return repoName, nil, storage.ErrObjectNotExist
+}
+
+func (server *Server) operationDownload(ctx context.Context, repoName string, o Object, authorization string) Object {
+	repoConf := server.Repositories[repoName]
+	keyRepo, info, err := server.locateObject(ctx, repoName, o.Oid, int64(o.Size))
+	if err == errFetching {
+		// The object is served through lfs server until the copy completes
+		recordDownload(repoName, o.Oid, info.Size)
+		return server.proxyAction(repoName, OperationDownload, o, authorization)
+	}
 	if err != nil {
-		return ""
+		if err != storage.ErrObjectNotExist {
+			log.Print(err)
+		}
+		return Object{Oid: o.Oid, Size: o.Size, Error: objectError(err)}
+	}
+
+	// The expiration is calculated before signing so that the response never claims longer than the real one.
+	expiresIn, expiresAt := repoConf.expiration()
+	u, err := repoConf.storageEngine.Get(ctx, repoConf.bucketName, keyRepo, o.Oid)
+	if err != nil {
+		log.Print(err)
+		return Object{Oid: o.Oid, Size: o.Size, Error: objectError(err)}
+	}
+	header := map[string]string{"Content-Type": "application/octet-stream"}
+	if h, ok := repoConf.storageEngine.(storage.HeaderStorage); ok {
+		for k, v := range h.DownloadHeader(ctx, repoConf.bucketName, keyRepo, o.Oid) {
+			header[k] = v
+		}
+	}
+	recordDownload(repoName, o.Oid, info.Size)
+	return Object{
+		Oid:          o.Oid,
+		Size:         o.Size,
+		Autheticated: true,
+		Actions: &Action{
+			Download: &Download{Href: u, ExpiresIn: expiresIn, ExpiresAt: expiresAt, Header: header},
+		},
 	}
-	return u
 }
 
-func (server *Server) operationUpload(repoName, objectID string) string {
+func (server *Server) operationUpload(ctx context.Context, repoName string, o Object, authorization string) Object {
 	repoConf := server.Repositories[repoName]
-	u, err := repoConf.storageEngine.Put(repoConf.bucketName, repoName, objectID)
+	expiresIn, expiresAt := repoConf.expiration()
+	u, err := repoConf.storageEngine.Put(ctx, repoConf.bucketName, repoName, o.Oid)
 	if err != nil {
 		log.Print(err)
-		return ""
+		return Object{Oid: o.Oid, Size: o.Size, Error: objectError(err)}
+	}
+
+	var a *Action
+	if u != "" {
+		var header map[string]string
+		if h, ok := repoConf.storageEngine.(storage.HeaderStorage); ok {
+			header = h.UploadHeader(ctx, repoConf.bucketName, repoName, o.Oid)
+		}
+		a = &Action{
+			Upload: &Upload{Href: u, Header: header, ExpiresIn: expiresIn, ExpiresAt: expiresAt},
+			Verify: &Verify{
+				Href:      server.baseURL + "/" + repoName + ".git/info/lfs/verify",
+				Header:    map[string]string{"Authorization": authorization},
+				ExpiresIn: expiresIn,
+				ExpiresAt: expiresAt,
+			},
+		}
+	}
+	return Object{
+		Oid:          o.Oid,
+		Size:         o.Size,
+		Autheticated: true,
+		Actions:      a,
+	}
+}
+
+// storageHandler passes the request to the storage which serves objects by itself.
+func (server *Server) storageHandler(w http.ResponseWriter, req *http.Request) {
+	s := strings.SplitN(strings.TrimPrefix(req.URL.Path, storage.ObjectPathPrefix), "/", 3)
+	if len(s) != 3 {
+		http.NotFound(w, req)
+		return
+	}
+	repoName := s[0] + "/" + s[1]
+	if name, ok := server.aliases[repoName]; ok {
+		repoName = name
+	}
+	repoConf, ok := server.Repositories[repoName]
+	if ok == false {
+		http.NotFound(w, req)
+		return
+	}
+	h, ok := repoConf.storageEngine.(http.Handler)
+	if ok == false {
+		http.NotFound(w, req)
+		return
 	}
-	return u
+	h.ServeHTTP(w, req)
 }
 
 func (server *Server) ServeMux() http.Handler {
 	m := &http.ServeMux{}
-	m.HandleFunc("/", server.batchHandler)
-	return m
+	m.HandleFunc("/", server.handler)
+	m.HandleFunc(storage.ObjectPathPrefix, server.storageHandler)
+	return withRequestID(m)
 }
 
-func ObjectServer(disableHttps bool, certFile, keyFile string, repos map[string]*config.RepositoryConfig) {
-	serv := NewServer(repos)
-	if disableHttps {
+func ObjectServer(conf *config.Config, serv *Server) {
+	if conf.DisableHttps {
 		s := &http.Server{
 			Addr:    ":8080",
 			Handler: serv.ServeMux(),
@@ -227,6 +621,6 @@ func ObjectServer(disableHttps bool, certFile, keyFile string, repos map[string]
 			Handler: serv.ServeMux(),
 		}
 		log.Println("starting lfs server on port 443...")
-		log.Print(s.ListenAndServeTLS(certFile, keyFile))
+		log.Print(s.ListenAndServeTLS(conf.CertFile, conf.KeyFile))
 	}
 }
@@ -2,18 +2,125 @@ package lfs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/database"
 )
 
+func TestMain(m *testing.M) {
+	f, err := ioutil.TempFile("", "lfs_test")
+	if err != nil {
+		panic(err)
+	}
+	f.Close()
+	db, err := bolt.Open(f.Name(), 0644, nil)
+	if err != nil {
+		panic(err)
+	}
+	database.Conn = db
+	database.SaveRepositoryUsers("f110/test1", []string{"test-user", "other-user", "admin-user"})
+	SessionStore.Store("for-test", &Session{ID: "for-test", Username: "test-user"})
+	SessionStore.Store("for-test-other", &Session{ID: "for-test-other", Username: "other-user"})
+	SessionStore.Store("for-test-admin", &Session{ID: "for-test-admin", Username: "admin-user"})
+	SessionStore.Store("for-test-stranger", &Session{ID: "for-test-stranger", Username: "stranger"})
+
+	code := m.Run()
+	db.Close()
+	os.Remove(f.Name())
+	os.Exit(code)
+}
+
+// newLocalTestServer returns the server which stores objects on the local filesystem.
+func newLocalTestServer(t *testing.T, repoConf *config.RepositoryConfig) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "lfs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler http.Handler
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req)
+	}))
+
+	repoConf.Owner = "f110"
+	repoConf.Repo = "test1"
+	repoConf.Storage = "local"
+	repoConf.SigningKey = "test"
+	repoConf.Drivers = map[string]config.DriverConfig{"local": {"path": dir}}
+	serv, err := NewServer(&config.Config{URL: s.URL, Repositories: map[string]*config.RepositoryConfig{"f110/test1": repoConf}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler = serv.ServeMux()
+
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func doBatchRequest(t *testing.T, url, repoName, token string, batchReq *BatchRequest) *BatchResponse {
+	reqBody, err := json.Marshal(batchReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, url+"/"+repoName+".git/info/lfs/objects/batch", bytes.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", ContentType)
+	req.Header.Add("Accept", ContentType)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", res.StatusCode)
+	}
+
+	batchRes := &BatchResponse{}
+	err = json.NewDecoder(res.Body).Decode(batchRes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return batchRes
+}
+
+func doAction(t *testing.T, method, href string, header map[string]string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, href, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
 func TestServer(t *testing.T) {
-	serv := NewServer(map[string]*config.RepositoryConfig{"f110/test1": {Owner: "f110", Repo: "test1", Storage: "nop"}})
+	serv, err := NewServer(&config.Config{Repositories: map[string]*config.RepositoryConfig{"f110/test1": {Owner: "f110", Repo: "test1", Storage: "nop"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
 	s := httptest.NewServer(serv.ServeMux())
 
 	t.Run("batchHandler_download", func(t *testing.T) {
@@ -63,9 +170,16 @@ func TestServer(t *testing.T) {
 		if batchRes.Objects[0].Actions.Download.Href == "" {
 			t.Error("Response: download url is not found")
 		}
-		if batchRes.Objects[0].Actions.Download.ExpiresIn < time.Now().Add(1*time.Minute).Unix() {
+		if batchRes.Objects[0].Actions.Download.ExpiresIn < 60 {
 			t.Error("Response: expires is too short or not present")
 		}
+		expiresAt, err := time.Parse(time.RFC3339, batchRes.Objects[0].Actions.Download.ExpiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expiresAt.Before(time.Now().Add(1 * time.Minute)) {
+			t.Error("Response: expires_at is too short")
+		}
 	})
 
 	t.Run("batchHandler_upload", func(t *testing.T) {
@@ -115,10 +229,229 @@ func TestServer(t *testing.T) {
 		if batchRes.Objects[0].Actions.Upload.Href == "" {
 			t.Error("Response: download url is not found")
 		}
-		if batchRes.Objects[0].Actions.Upload.ExpiresIn < time.Now().Add(1*time.Minute).Unix() {
+		if batchRes.Objects[0].Actions.Upload.ExpiresIn < 60 {
 			t.Error("Response: expires is too short or not present")
 		}
+		expiresAt, err := time.Parse(time.RFC3339, batchRes.Objects[0].Actions.Upload.ExpiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expiresAt.Before(time.Now().Add(1 * time.Minute)) {
+			t.Error("Response: expires_at is too short")
+		}
 	})
 
 	s.Close()
 }
+
+func TestErrorResponse(t *testing.T) {
+	serv, err := NewServer(&config.Config{Repositories: map[string]*config.RepositoryConfig{"f110/test1": {Owner: "f110", Repo: "test1", Storage: "nop"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(serv.ServeMux())
+	defer s.Close()
+
+	cases := []struct {
+		Name       string
+		Path       string
+		Token      string
+		Body       string
+		StatusCode int
+	}{
+		{Name: "no_credential", Path: "/f110/test1.git/info/lfs/objects/batch", Body: "{}", StatusCode: http.StatusUnauthorized},
+		{Name: "unknown_session", Path: "/f110/test1.git/info/lfs/objects/batch", Token: "unknown", Body: "{}", StatusCode: http.StatusUnauthorized},
+		{Name: "forbidden", Path: "/f110/test1.git/info/lfs/objects/batch", Token: "for-test-stranger", Body: "{}", StatusCode: http.StatusForbidden},
+		{Name: "unknown_repository", Path: "/f110/unknown.git/info/lfs/objects/batch", Token: "for-test", Body: "{}", StatusCode: http.StatusNotFound},
+		{Name: "invalid_json", Path: "/f110/test1.git/info/lfs/objects/batch", Token: "for-test", Body: "{", StatusCode: http.StatusUnprocessableEntity},
+		{Name: "unknown_operation", Path: "/f110/test1.git/info/lfs/objects/batch", Token: "for-test", Body: `{"operation": "delete"}`, StatusCode: http.StatusUnprocessableEntity},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, s.URL+c.Path, bytes.NewReader([]byte(c.Body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Add("Content-Type", ContentType)
+			if c.Token != "" {
+				req.Header.Add("Authorization", "Bearer "+c.Token)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != c.StatusCode {
+				t.Errorf("unexpected status code: %d", res.StatusCode)
+			}
+			if res.Header.Get("Content-Type") != ContentType {
+				t.Errorf("content-type is not %s. %s", ContentType, res.Header.Get("Content-Type"))
+			}
+			if c.StatusCode == http.StatusUnauthorized && strings.HasPrefix(res.Header.Get("LFS-Authenticate"), "Bearer ") == false {
+				t.Errorf("unexpected LFS-Authenticate header: %q", res.Header.Get("LFS-Authenticate"))
+			}
+			var errRes ErrorResponse
+			if err := json.NewDecoder(res.Body).Decode(&errRes); err != nil {
+				t.Fatal(err)
+			}
+			if errRes.Message == "" || errRes.RequestID == "" {
+				t.Errorf("message or request_id is empty: %v", errRes)
+			}
+		})
+	}
+}
+
+func TestDownloadNotExist(t *testing.T) {
+	s, cleanup := newLocalTestServer(t, &config.RepositoryConfig{})
+	defer cleanup()
+
+	content := []byte("hello world")
+	oid := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{Operation: OperationUpload, Objects: []Object{{Oid: oid, Size: len(content)}}})
+	res := doAction(t, http.MethodPut, batchRes.Objects[0].Actions.Upload.Href, nil, content)
+	res.Body.Close()
+
+	missingOid := "1111111111111111111111111111111111111111111111111111111111111111"
+	batchRes = doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+		Operation: OperationDownload,
+		Objects:   []Object{{Oid: missingOid, Size: 1}, {Oid: oid, Size: len(content)}},
+	})
+	if len(batchRes.Objects) != 2 {
+		t.Fatalf("Response: objects length is mismatch: %d", len(batchRes.Objects))
+	}
+	if batchRes.Objects[0].Oid != missingOid || batchRes.Objects[0].Error == nil || batchRes.Objects[0].Error.Code != ErrorCodeNotExist {
+		t.Errorf("missing object does not have error: %v", batchRes.Objects[0])
+	}
+	if batchRes.Objects[0].Actions != nil {
+		t.Errorf("missing object has actions: %v", batchRes.Objects[0].Actions)
+	}
+	if batchRes.Objects[1].Oid != oid || batchRes.Objects[1].Error != nil || batchRes.Objects[1].Actions.Download == nil {
+		t.Errorf("existing object does not have download action: %v", batchRes.Objects[1])
+	}
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	serv, err := NewServer(&config.Config{
+		BatchConcurrency: 4,
+		MaxBatchSize:     50,
+		Repositories:     map[string]*config.RepositoryConfig{"f110/test1": {Owner: "f110", Repo: "test1", Storage: "nop"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(serv.ServeMux())
+	defer s.Close()
+
+	objects := make([]Object, 0, 51)
+	for i := 0; i < 51; i++ {
+		objects = append(objects, Object{Oid: fmt.Sprintf("%064x", i), Size: i})
+	}
+
+	t.Run("ordering", func(t *testing.T) {
+		batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{Operation: OperationDownload, Objects: objects[:50]})
+		if len(batchRes.Objects) != 50 {
+			t.Fatalf("Response: objects length is mismatch: %d", len(batchRes.Objects))
+		}
+		for i, o := range batchRes.Objects {
+			if o.Oid != objects[i].Oid || o.Size != objects[i].Size {
+				t.Fatalf("Response: order of objects is not preserved at %d: %s", i, o.Oid)
+			}
+		}
+	})
+
+	t.Run("too_many_objects", func(t *testing.T) {
+		reqBody, err := json.Marshal(&BatchRequest{Operation: OperationDownload, Objects: objects})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := doAction(t, http.MethodPost, s.URL+"/f110/test1.git/info/lfs/objects/batch", map[string]string{"Authorization": "Bearer for-test"}, reqBody)
+		res.Body.Close()
+		if res.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("unexpected status code: %d", res.StatusCode)
+		}
+	})
+}
+
+func TestURLExpire(t *testing.T) {
+	s, cleanup := newLocalTestServer(t, &config.RepositoryConfig{URLExpire: config.Duration{Duration: 2 * time.Minute}})
+	defer cleanup()
+
+	batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{Operation: OperationUpload, Objects: []Object{{Oid: fmt.Sprintf("%064x", 1), Size: 1}}})
+	upload := batchRes.Objects[0].Actions.Upload
+	if upload.ExpiresIn != 120 {
+		t.Errorf("expires_in is not seconds of url_expire: %d", upload.ExpiresIn)
+	}
+	expiresAt, err := time.Parse(time.RFC3339, upload.ExpiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt.After(time.Now().Add(2*time.Minute)) || expiresAt.Before(time.Now().Add(time.Minute)) {
+		t.Errorf("expires_at is not aligned with url_expire: %s", upload.ExpiresAt)
+	}
+
+	u, err := url.Parse(upload.Href)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires < expiresAt.Unix() {
+		t.Errorf("signed URL expires before expires_at: %d < %d", expires, expiresAt.Unix())
+	}
+}
+
+func TestAliases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var handler http.Handler
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req)
+	}))
+	defer s.Close()
+	serv, err := NewServer(&config.Config{URL: s.URL, Repositories: map[string]*config.RepositoryConfig{
+		"f110/test1": {Owner: "f110", Repo: "test1", Storage: "local", SigningKey: "test", Drivers: map[string]config.DriverConfig{"local": {"path": dir}}, Aliases: []string{"f110/old-name"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler = serv.ServeMux()
+
+	oid := "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+	repoConf := serv.Repositories["f110/test1"]
+	w, err := repoConf.storageEngine.PutObject(context.Background(), "", "f110/old-name", oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello world"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+		Operation: OperationDownload,
+		Objects:   []Object{{Oid: oid, Size: 11}},
+	})
+	if batchRes.Objects[0].Error != nil {
+		t.Fatalf("object in the key space of alias is not found: %s", batchRes.Objects[0].Error.Message)
+	}
+	res := doAction(t, http.MethodGet, batchRes.Objects[0].Actions.Download.Href, nil, nil)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "hello world" {
+		t.Errorf("unexpected response: %d %s", res.StatusCode, body)
+	}
+
+	_, err = NewServer(&config.Config{Repositories: map[string]*config.RepositoryConfig{
+		"f110/test1": {Owner: "f110", Repo: "test1", Storage: "nop", Aliases: []string{"f110/test2"}},
+		"f110/test2": {Owner: "f110", Repo: "test2", Storage: "nop"},
+	}})
+	if err == nil {
+		t.Error("alias which conflicts with the repository is accepted")
+	}
+}
@@ -0,0 +1,51 @@
+package lfs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+// ListObjects calls fn with each object of the repository, including the objects in the key spaces of aliases.
+// If the repository is in the pool, only the objects which the repository refers are listed.
+func (server *Server) ListObjects(ctx context.Context, repoName string, fn func(*storage.ListedObject) error) error {
+	repoConf, ok := server.Repositories[repoName]
+	if ok == false {
+		return fmt.Errorf("lfs: %s is not found", repoName)
+	}
+	keySpaces := append([]string{repoName}, repoConf.aliases...)
+	if repoConf.pool != "" {
+		// All repositories in the pool share the key space
+		keySpaces = keySpaces[:1]
+	}
+
+	for _, keySpace := range keySpaces {
+		cursor := ""
+		for {
+			objects, next, err := repoConf.storageEngine.List(ctx, repoConf.bucketName, keySpace, cursor)
+			if err != nil {
+				return err
+			}
+			for _, o := range objects {
+				if repoConf.pool != "" {
+					ok, err := server.isReferenced(repoName, o.ObjectID)
+					if err != nil {
+						return err
+					}
+					if ok == false {
+						continue
+					}
+				}
+				if err := fn(o); err != nil {
+					return err
+				}
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package lfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+func TestListObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serv, err := NewServer(&config.Config{Repositories: map[string]*config.RepositoryConfig{
+		"f110/test1": {Owner: "f110", Repo: "test1", Storage: "local", SigningKey: "test", Drivers: map[string]config.DriverConfig{"local": {"path": dir}}, Aliases: []string{"f110/test1-old"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := serv.Repositories["f110/test1"].storageEngine
+	oid1, oid2, oid3 := strings.Repeat("1", 64), strings.Repeat("2", 64), strings.Repeat("3", 64)
+	for _, v := range []struct{ repo, oid string }{{"f110/test1", oid1}, {"f110/test1-old", oid2}, {"f110/test2", oid3}} {
+		w, err := engine.PutObject(context.Background(), "", v.repo, v.oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(v.oid))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listed := make([]string, 0)
+	err = serv.ListObjects(context.Background(), "f110/test1", func(o *storage.ListedObject) error {
+		if o.Size != int64(len(o.ObjectID)) {
+			t.Errorf("unexpected size of %s: %d", o.ObjectID, o.Size)
+		}
+		listed = append(listed, o.ObjectID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != oid1+","+oid2 {
+		t.Errorf("unexpected objects: %v", listed)
+	}
+}
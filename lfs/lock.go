@@ -0,0 +1,246 @@
+package lfs
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/f110/git-lfs-cloud/database"
+)
+
+const (
+	DefaultLockLimit = 100
+)
+
+type Lock struct {
+	ID       string     `json:"id"`
+	Path     string     `json:"path"`
+	LockedAt time.Time  `json:"locked_at"`
+	Owner    *LockOwner `json:"owner,omitempty"`
+}
+
+type LockOwner struct {
+	Name string `json:"name"`
+}
+
+type Ref struct {
+	Name string `json:"name"`
+}
+
+type CreateLockRequest struct {
+	Path string `json:"path"`
+	Ref  *Ref   `json:"ref,omitempty"`
+}
+
+type LockResponse struct {
+	Lock    *Lock  `json:"lock,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type LockListResponse struct {
+	Locks      []Lock `json:"locks"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type VerifyLocksRequest struct {
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Ref    *Ref   `json:"ref,omitempty"`
+}
+
+type VerifyLocksResponse struct {
+	Ours       []Lock `json:"ours"`
+	Theirs     []Lock `json:"theirs"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type UnlockRequest struct {
+	Force bool `json:"force,omitempty"`
+	Ref   *Ref `json:"ref,omitempty"`
+}
+
+func newLock(l *database.Lock) Lock {
+	return Lock{ID: l.ID, Path: l.Path, LockedAt: l.LockedAt, Owner: &LockOwner{Name: l.Owner}}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// paginateLocks returns the locks which start from cursor and the cursor of the next page.
+func paginateLocks(locks []*database.Lock, cursor string, limit int) ([]*database.Lock, string) {
+	if limit <= 0 {
+		limit = DefaultLockLimit
+	}
+	start := 0
+	if cursor != "" {
+		start = len(locks)
+		for i, l := range locks {
+			if l.ID == cursor {
+				start = i
+				break
+			}
+		}
+	}
+	locks = locks[start:]
+	if len(locks) > limit {
+		return locks[:limit], locks[limit].ID
+	}
+	return locks, ""
+}
+
+func (server *Server) createLockHandler(w http.ResponseWriter, req *http.Request, repoName, username string) {
+	var lockReq CreateLockRequest
+	err := json.NewDecoder(req.Body).Decode(&lockReq)
+	if err != nil || lockReq.Path == "" {
+		writeError(w, req, http.StatusUnprocessableEntity, "invalid request")
+		return
+	}
+
+	l, err := database.CreateLock(repoName, lockReq.Path, username)
+	switch err {
+	case nil:
+	case database.ErrLockExists:
+		lock := newLock(l)
+		writeJSON(w, http.StatusConflict, &LockResponse{Lock: &lock, Message: "already created lock"})
+		return
+	default:
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to create lock")
+		return
+	}
+
+	lock := newLock(l)
+	writeJSON(w, http.StatusCreated, &LockResponse{Lock: &lock})
+}
+
+func (server *Server) listLocksHandler(w http.ResponseWriter, req *http.Request, repoName, username string) {
+	q := req.URL.Query()
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, req, http.StatusUnprocessableEntity, "invalid limit")
+			return
+		}
+		limit = i
+	}
+
+	locks, err := database.ReadLocks(repoName)
+	if err != nil {
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to read locks")
+		return
+	}
+
+	filtered := make([]*database.Lock, 0, len(locks))
+	for _, l := range locks {
+		if p := q.Get("path"); p != "" && l.Path != p {
+			continue
+		}
+		if id := q.Get("id"); id != "" && l.ID != id {
+			continue
+		}
+		filtered = append(filtered, l)
+	}
+
+	page, next := paginateLocks(filtered, q.Get("cursor"), limit)
+	res := &LockListResponse{Locks: make([]Lock, 0, len(page)), NextCursor: next}
+	for _, l := range page {
+		res.Locks = append(res.Locks, newLock(l))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (server *Server) verifyLocksHandler(w http.ResponseWriter, req *http.Request, repoName, username string) {
+	var verifyReq VerifyLocksRequest
+	err := json.NewDecoder(req.Body).Decode(&verifyReq)
+	if err != nil {
+		writeError(w, req, http.StatusUnprocessableEntity, "invalid request")
+		return
+	}
+
+	locks, err := database.ReadLocks(repoName)
+	if err != nil {
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to read locks")
+		return
+	}
+
+	page, next := paginateLocks(locks, verifyReq.Cursor, verifyReq.Limit)
+	res := &VerifyLocksResponse{Ours: make([]Lock, 0), Theirs: make([]Lock, 0), NextCursor: next}
+	for _, l := range page {
+		if l.Owner == username {
+			res.Ours = append(res.Ours, newLock(l))
+		} else {
+			res.Theirs = append(res.Theirs, newLock(l))
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (server *Server) unlockHandler(w http.ResponseWriter, req *http.Request, repoName, username, id string) {
+	var unlockReq UnlockRequest
+	err := json.NewDecoder(req.Body).Decode(&unlockReq)
+	if err != nil {
+		writeError(w, req, http.StatusUnprocessableEntity, "invalid request")
+		return
+	}
+
+	l, err := database.ReadLock(repoName, id)
+	switch err {
+	case nil:
+	case database.ErrNotFound:
+		writeError(w, req, http.StatusNotFound, "lock not found")
+		return
+	default:
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to read lock")
+		return
+	}
+	if l.Owner != username {
+		if unlockReq.Force == false {
+			writeError(w, req, http.StatusForbidden, "lock is owned by "+l.Owner)
+			return
+		}
+		if server.isAdmin(repoName, username) == false {
+			writeError(w, req, http.StatusForbidden, "force unlock is permitted to admins only")
+			return
+		}
+		log.Printf("lfs: %s force-unlocked %s of %s in %s", username, l.Path, l.Owner, repoName)
+	}
+
+	err = database.DeleteLock(repoName, id)
+	switch err {
+	case nil:
+	case database.ErrNotFound:
+		writeError(w, req, http.StatusNotFound, "lock not found")
+		return
+	default:
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to delete lock")
+		return
+	}
+
+	lock := newLock(l)
+	writeJSON(w, http.StatusOK, &LockResponse{Lock: &lock})
+}
+
+// isAdmin reports whether the user can force-unlock the locks of other users.
+func (server *Server) isAdmin(repoName, username string) bool {
+	for _, v := range server.Repositories[repoName].admins {
+		if v == username {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package lfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+func doLockRequest(t *testing.T, method, url, token string, body interface{}) *http.Response {
+	var buf []byte
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = b
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", ContentType)
+	req.Header.Add("Accept", ContentType)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestLock(t *testing.T) {
+	serv, err := NewServer(&config.Config{Repositories: map[string]*config.RepositoryConfig{"f110/test1": {Owner: "f110", Repo: "test1", Storage: "nop", Admins: []string{"admin-user"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(serv.ServeMux())
+	defer s.Close()
+	locksURL := s.URL + "/f110/test1.git/info/lfs/locks"
+
+	var lock Lock
+	t.Run("create", func(t *testing.T) {
+		res := doLockRequest(t, http.MethodPost, locksURL, "for-test", &CreateLockRequest{Path: "foo/bar.zip", Ref: &Ref{Name: "refs/heads/master"}})
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+		var lockRes LockResponse
+		if err := json.NewDecoder(res.Body).Decode(&lockRes); err != nil {
+			t.Fatal(err)
+		}
+		if lockRes.Lock == nil || lockRes.Lock.ID == "" || lockRes.Lock.Path != "foo/bar.zip" {
+			t.Fatalf("unexpected lock: %v", lockRes.Lock)
+		}
+		if lockRes.Lock.Owner == nil || lockRes.Lock.Owner.Name != "test-user" {
+			t.Errorf("unexpected owner: %v", lockRes.Lock.Owner)
+		}
+		lock = *lockRes.Lock
+	})
+
+	t.Run("create_conflict", func(t *testing.T) {
+		res := doLockRequest(t, http.MethodPost, locksURL, "for-test-other", &CreateLockRequest{Path: "foo/bar.zip"})
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusConflict {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+		var lockRes LockResponse
+		if err := json.NewDecoder(res.Body).Decode(&lockRes); err != nil {
+			t.Fatal(err)
+		}
+		if lockRes.Lock == nil || lockRes.Lock.ID != lock.ID {
+			t.Errorf("conflict response does not contain existing lock: %v", lockRes.Lock)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		res := doLockRequest(t, http.MethodGet, locksURL+"?path=foo/bar.zip", "for-test", nil)
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+		var listRes LockListResponse
+		if err := json.NewDecoder(res.Body).Decode(&listRes); err != nil {
+			t.Fatal(err)
+		}
+		if len(listRes.Locks) != 1 || listRes.Locks[0].ID != lock.ID {
+			t.Errorf("unexpected locks: %v", listRes.Locks)
+		}
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		res := doLockRequest(t, http.MethodPost, locksURL+"/verify", "for-test-other", &VerifyLocksRequest{})
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+		var verifyRes VerifyLocksResponse
+		if err := json.NewDecoder(res.Body).Decode(&verifyRes); err != nil {
+			t.Fatal(err)
+		}
+		if len(verifyRes.Ours) != 0 || len(verifyRes.Theirs) != 1 {
+			t.Errorf("unexpected result: ours=%v theirs=%v", verifyRes.Ours, verifyRes.Theirs)
+		}
+	})
+
+	t.Run("unlock_not_owner", func(t *testing.T) {
+		res := doLockRequest(t, http.MethodPost, locksURL+"/"+lock.ID+"/unlock", "for-test-other", &UnlockRequest{})
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+	})
+
+	t.Run("unlock_force_not_admin", func(t *testing.T) {
+		res := doLockRequest(t, http.MethodPost, locksURL+"/"+lock.ID+"/unlock", "for-test-other", &UnlockRequest{Force: true})
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+	})
+
+	t.Run("unlock_force", func(t *testing.T) {
+		res := doLockRequest(t, http.MethodPost, locksURL+"/"+lock.ID+"/unlock", "for-test-admin", &UnlockRequest{Force: true})
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+	})
+
+	t.Run("unlock_not_found", func(t *testing.T) {
+		res := doLockRequest(t, http.MethodPost, locksURL+"/"+lock.ID+"/unlock", "for-test", &UnlockRequest{})
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package lfs
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+const (
+	DefaultMultipartThreshold = 100 * 1024 * 1024
+)
+
+type Part struct {
+	Href      string            `json:"href"`
+	Method    string            `json:"method,omitempty"`
+	Header    map[string]string `json:"header,omitempty"`
+	Pos       int64             `json:"pos"`
+	Size      int64             `json:"size"`
+	ExpiresAt string            `json:"expires_at,omitempty"`
+	ExpiresIn int64             `json:"expires_in,omitempty"`
+}
+
+type Commit Download
+type Abort Download
+
+func (server *Server) operationMultipartUpload(ctx context.Context, repoName string, o Object, authorization string) Object {
+	repoConf := server.Repositories[repoName]
+	info, err := repoConf.storageEngine.Stat(ctx, repoConf.bucketName, repoName, o.Oid)
+	if err == nil && info.Size == int64(o.Size) {
+		// The object is already uploaded
+		return Object{Oid: o.Oid, Size: o.Size, Autheticated: true}
+	}
+	if err != nil && err != storage.ErrObjectNotExist {
+		log.Print(err)
+		return Object{Oid: o.Oid, Size: o.Size, Error: objectError(err)}
+	}
+
+	expiresIn, expiresAt := repoConf.expiration()
+	upload, err := repoConf.storageEngine.(storage.MultipartStorage).CreateMultipartUpload(ctx, repoConf.bucketName, repoName, o.Oid, int64(o.Size))
+	if err != nil {
+		log.Print(err)
+		return Object{Oid: o.Oid, Size: o.Size, Error: objectError(err)}
+	}
+
+	parts := make([]*Part, 0, len(upload.Parts))
+	for _, p := range upload.Parts {
+		parts = append(parts, &Part{
+			Href:      p.Href,
+			Method:    p.Method,
+			Header:    p.Header,
+			Pos:       p.Pos,
+			Size:      p.Size,
+			ExpiresIn: expiresIn,
+			ExpiresAt: expiresAt,
+		})
+	}
+	header := map[string]string{"Authorization": authorization}
+	q := url.Values{}
+	q.Set("upload_id", upload.UploadID)
+	multipartURL := server.baseURL + "/" + repoName + ".git/info/lfs/multipart/" + o.Oid
+	return Object{
+		Oid:          o.Oid,
+		Size:         o.Size,
+		Autheticated: true,
+		Actions: &Action{
+			Parts:  parts,
+			Commit: &Commit{Href: multipartURL + "/commit?" + q.Encode(), Header: header, ExpiresIn: expiresIn, ExpiresAt: expiresAt},
+			Abort:  &Abort{Href: multipartURL + "/abort?" + q.Encode(), Header: header, ExpiresIn: expiresIn, ExpiresAt: expiresAt},
+			Verify: &Verify{Href: server.baseURL + "/" + repoName + ".git/info/lfs/verify", Header: header, ExpiresIn: expiresIn, ExpiresAt: expiresAt},
+		},
+	}
+}
+
+// commitHandler completes the multipart upload and checks the size of the object.
+func (server *Server) commitHandler(w http.ResponseWriter, req *http.Request, repoName, objectID string) {
+	var obj Object
+	err := json.NewDecoder(req.Body).Decode(&obj)
+	if err != nil {
+		writeError(w, req, http.StatusUnprocessableEntity, "invalid request")
+		return
+	}
+	uploadID := req.URL.Query().Get("upload_id")
+	repoConf := server.Repositories[repoName]
+	multipart, ok := repoConf.storageEngine.(storage.MultipartStorage)
+	if ok == false || uploadID == "" {
+		writeError(w, req, http.StatusNotFound, "multipart upload not found")
+		return
+	}
+
+	err = multipart.CompleteMultipartUpload(req.Context(), repoConf.bucketName, repoName, objectID, uploadID, int64(obj.Size))
+	if err == storage.ErrPartsMismatch {
+		writeError(w, req, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		writeError(w, req, http.StatusUnprocessableEntity, "failed to complete multipart upload")
+		return
+	}
+	info, err := repoConf.storageEngine.Stat(req.Context(), repoConf.bucketName, repoName, objectID)
+	if err != nil {
+		log.Print(err)
+		writeError(w, req, http.StatusUnprocessableEntity, "object not found")
+		return
+	}
+	if info.Size != int64(obj.Size) {
+		writeError(w, req, http.StatusUnprocessableEntity, "size mismatch")
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (server *Server) abortHandler(w http.ResponseWriter, req *http.Request, repoName, objectID string) {
+	uploadID := req.URL.Query().Get("upload_id")
+	repoConf := server.Repositories[repoName]
+	multipart, ok := repoConf.storageEngine.(storage.MultipartStorage)
+	if ok == false || uploadID == "" {
+		writeError(w, req, http.StatusNotFound, "multipart upload not found")
+		return
+	}
+
+	err := multipart.AbortMultipartUpload(req.Context(), repoConf.bucketName, repoName, objectID, uploadID)
+	if err == storage.ErrInvalidUploadID {
+		writeError(w, req, http.StatusNotFound, "multipart upload not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to abort multipart upload")
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusOK)
+}
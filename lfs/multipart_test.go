@@ -0,0 +1,125 @@
+package lfs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+type fakeMultipartStorage struct {
+	storage.Nop
+
+	completed map[string]bool
+	aborted   map[string]bool
+}
+
+func (f *fakeMultipartStorage) Stat(ctx context.Context, bucketName, repo, objectID string) (*storage.ObjectInfo, error) {
+	if f.completed["upload-"+objectID] {
+		return &storage.ObjectInfo{Size: 1000}, nil
+	}
+	return nil, storage.ErrObjectNotExist
+}
+
+func (*fakeMultipartStorage) CreateMultipartUpload(ctx context.Context, bucketName, repo, objectID string, size int64) (*storage.MultipartUpload, error) {
+	return &storage.MultipartUpload{
+		UploadID: "upload-" + objectID,
+		Parts: []storage.Part{
+			{Number: 1, Href: "https://example.com/1", Method: http.MethodPut, Pos: 0, Size: size / 2},
+			{Number: 2, Href: "https://example.com/2", Method: http.MethodPut, Pos: size / 2, Size: size - size/2},
+		},
+	}, nil
+}
+
+func (f *fakeMultipartStorage) CompleteMultipartUpload(ctx context.Context, bucketName, repo, objectID, uploadID string, size int64) error {
+	f.completed[uploadID] = true
+	return nil
+}
+
+func (f *fakeMultipartStorage) AbortMultipartUpload(ctx context.Context, bucketName, repo, objectID, uploadID string) error {
+	f.aborted[uploadID] = true
+	return nil
+}
+
+func TestMultipartUpload(t *testing.T) {
+	serv, err := NewServer(&config.Config{Repositories: map[string]*config.RepositoryConfig{
+		"f110/test1": {Owner: "f110", Repo: "test1", Storage: "nop", MultipartThreshold: 100},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeMultipartStorage{completed: make(map[string]bool), aborted: make(map[string]bool)}
+	repoConf := serv.Repositories["f110/test1"]
+	repoConf.storageEngine = fake
+	serv.Repositories["f110/test1"] = repoConf
+	s := httptest.NewServer(serv.ServeMux())
+	defer s.Close()
+	serv.baseURL = s.URL
+
+	t.Run("basic", func(t *testing.T) {
+		batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+			Operation: OperationUpload,
+			Transfers: []string{TransferBasic},
+			Objects:   []Object{{Oid: "1234567890", Size: 1000}},
+		})
+		if batchRes.Transfer == TransferMultipart {
+			t.Error("multipart-basic is chosen without the client support")
+		}
+	})
+
+	t.Run("below_threshold", func(t *testing.T) {
+		batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+			Operation: OperationUpload,
+			Transfers: []string{TransferMultipart, TransferBasic},
+			Objects:   []Object{{Oid: "1234567890", Size: 10}},
+		})
+		if batchRes.Transfer == TransferMultipart {
+			t.Error("multipart-basic is chosen for the small object")
+		}
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+			Operation: OperationUpload,
+			Transfers: []string{TransferMultipart, TransferBasic},
+			Objects:   []Object{{Oid: "1234567890", Size: 1000}, {Oid: "abcdef0123", Size: 1000}},
+		})
+		if batchRes.Transfer != TransferMultipart {
+			t.Fatalf("unexpected transfer: %s", batchRes.Transfer)
+		}
+		a := batchRes.Objects[0].Actions
+		if a == nil || len(a.Parts) != 2 || a.Commit == nil || a.Abort == nil || a.Verify == nil {
+			t.Fatalf("unexpected actions: %v", a)
+		}
+		if a.Parts[1].Pos != 500 || a.Parts[1].Size != 500 {
+			t.Errorf("unexpected part: %v", a.Parts[1])
+		}
+
+		body, err := json.Marshal(&Object{Oid: "1234567890", Size: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := doAction(t, http.MethodPost, a.Commit.Href, a.Commit.Header, body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: %d", res.StatusCode)
+		}
+		if fake.completed["upload-1234567890"] == false {
+			t.Error("multipart upload is not completed")
+		}
+
+		abort := batchRes.Objects[1].Actions.Abort
+		res = doAction(t, http.MethodPost, abort.Href, abort.Header, nil)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status code: %d", res.StatusCode)
+		}
+		if fake.aborted["upload-abcdef0123"] == false {
+			t.Error("multipart upload is not aborted")
+		}
+	})
+}
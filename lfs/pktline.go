@@ -0,0 +1,147 @@
+package lfs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	pktMaxDataLen = 65516
+)
+
+const (
+	pktData = iota
+	pktFlush
+	pktDelim
+)
+
+var (
+	errInvalidPacket = errors.New("invalid packet")
+)
+
+// pktline reads and writes the packets of git's pkt-line format.
+type pktline struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func newPktline(r io.Reader, w io.Writer) *pktline {
+	return &pktline{r: bufio.NewReader(r), w: w}
+}
+
+func (p *pktline) readPacket() ([]byte, int, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(p.r, head[:]); err != nil {
+		return nil, 0, err
+	}
+	l, err := strconv.ParseUint(string(head[:]), 16, 16)
+	if err != nil {
+		return nil, 0, errInvalidPacket
+	}
+	switch {
+	case l == 0:
+		return nil, pktFlush, nil
+	case l == 1:
+		return nil, pktDelim, nil
+	case l < 4:
+		return nil, 0, errInvalidPacket
+	}
+
+	buf := make([]byte, l-4)
+	if _, err := io.ReadFull(p.r, buf); err != nil {
+		return nil, 0, err
+	}
+	return buf, pktData, nil
+}
+
+// readLines reads the text packets until the flush or delim packet.
+func (p *pktline) readLines() ([]string, int, error) {
+	lines := make([]string, 0)
+	for {
+		buf, t, err := p.readPacket()
+		if err != nil {
+			return nil, 0, err
+		}
+		if t != pktData {
+			return lines, t, nil
+		}
+		lines = append(lines, strings.TrimSuffix(string(buf), "\n"))
+	}
+}
+
+func (p *pktline) writePacket(buf []byte) error {
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > pktMaxDataLen {
+			n = pktMaxDataLen
+		}
+		if _, err := fmt.Fprintf(p.w, "%04x", n+4); err != nil {
+			return err
+		}
+		if _, err := p.w.Write(buf[:n]); err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+func (p *pktline) writeLine(s string) error {
+	return p.writePacket([]byte(s + "\n"))
+}
+
+func (p *pktline) writeFlush() error {
+	_, err := io.WriteString(p.w, "0000")
+	return err
+}
+
+func (p *pktline) writeDelim() error {
+	_, err := io.WriteString(p.w, "0001")
+	return err
+}
+
+// dataReader returns the reader of binary data packets which ends at the flush packet.
+func (p *pktline) dataReader() io.Reader {
+	return &pktDataReader{p: p}
+}
+
+type pktDataReader struct {
+	p   *pktline
+	buf []byte
+	eof bool
+}
+
+func (r *pktDataReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		buf, t, err := r.p.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		switch t {
+		case pktFlush:
+			r.eof = true
+		case pktDelim:
+			return 0, errInvalidPacket
+		default:
+			r.buf = buf
+		}
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Write writes b as data packets. The caller must write the flush packet after all data.
+func (p *pktline) Write(b []byte) (int, error) {
+	if err := p.writePacket(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
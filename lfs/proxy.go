@@ -0,0 +1,213 @@
+package lfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+const (
+	ModeDirect = "direct"
+	ModeProxy  = "proxy"
+)
+
+// operationProxy returns the actions which point to lfs server itself.
+func (server *Server) operationProxy(ctx context.Context, repoName string, operation string, o Object, authorization string) Object {
+	repoConf := server.Repositories[repoName]
+	var info *storage.ObjectInfo
+	var err error
+	if operation == OperationDownload {
+		_, info, err = server.locateObject(ctx, repoName, o.Oid, int64(o.Size))
+	} else {
+		info, err = repoConf.storageEngine.Stat(ctx, repoConf.bucketName, repoName, o.Oid)
+	}
+	switch {
+	case err == nil && operation == OperationUpload && info.Size == int64(o.Size):
+		// The object is already uploaded
+		return Object{Oid: o.Oid, Size: o.Size, Autheticated: true}
+	case err == storage.ErrObjectNotExist && operation == OperationUpload:
+	case err == errFetching:
+	case err != nil:
+		if err != storage.ErrObjectNotExist {
+			log.Print(err)
+		}
+		return Object{Oid: o.Oid, Size: o.Size, Error: objectError(err)}
+	}
+
+	if operation == OperationDownload {
+		recordDownload(repoName, o.Oid, info.Size)
+	}
+	return server.proxyAction(repoName, operation, o, authorization)
+}
+
+// proxyAction returns the action of the operation which points to lfs server itself.
+func (server *Server) proxyAction(repoName string, operation string, o Object, authorization string) Object {
+	expiresIn, expiresAt := server.Repositories[repoName].expiration()
+	action := &Download{
+		Href:      server.baseURL + "/" + repoName + ".git/info/lfs/objects/" + o.Oid,
+		Header:    map[string]string{"Authorization": authorization},
+		ExpiresIn: expiresIn,
+		ExpiresAt: expiresAt,
+	}
+	a := &Action{}
+	if operation == OperationUpload {
+		u := Upload(*action)
+		a.Upload = &u
+	} else {
+		a.Download = action
+	}
+	return Object{Oid: o.Oid, Size: o.Size, Autheticated: true, Actions: a}
+}
+
+// parseRange parses the Range header which has the single range.
+// If the header has multiple ranges, parseRange ignores it and the whole object is returned.
+func parseRange(h string, size int64) (offset int64, length int64, partial bool, err error) {
+	if h == "" || strings.HasPrefix(h, "bytes=") == false || strings.Contains(h, ",") {
+		return 0, size, false, nil
+	}
+	s := strings.SplitN(strings.TrimPrefix(h, "bytes="), "-", 2)
+	if len(s) != 2 {
+		return 0, 0, false, fmt.Errorf("invalid range: %s", h)
+	}
+	if s[0] == "" {
+		suffix, err := strconv.ParseInt(s[1], 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false, fmt.Errorf("invalid range: %s", h)
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, true, nil
+	}
+
+	start, err := strconv.ParseInt(s[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, fmt.Errorf("invalid range: %s", h)
+	}
+	end := size - 1
+	if s[1] != "" {
+		end, err = strconv.ParseInt(s[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, fmt.Errorf("invalid range: %s", h)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true, nil
+}
+
+// proxyDownloadHandler streams the object from the storage.
+func (server *Server) proxyDownloadHandler(w http.ResponseWriter, req *http.Request, repoName, objectID string) {
+	repoConf := server.Repositories[repoName]
+	// The repository which fetches objects also serves the objects which are being fetched
+	if repoConf.proxy == false && repoConf.upstream == nil && repoConf.migrateSource == nil {
+		writeError(w, req, http.StatusNotFound, "not found")
+		return
+	}
+	keyRepo, info, err := server.waitObject(req.Context(), repoName, objectID)
+	switch err {
+	case nil:
+	case storage.ErrObjectNotExist, storage.ErrInvalidObjectID:
+		writeError(w, req, http.StatusNotFound, "object not found")
+		return
+	default:
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to stat object")
+		return
+	}
+
+	offset, length, partial, err := parseRange(req.Header.Get("Range"), info.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		writeError(w, req, http.StatusRequestedRangeNotSatisfiable, err.Error())
+		return
+	}
+	var r io.ReadCloser
+	if partial {
+		r, err = storage.GetObjectRange(req.Context(), repoConf.storageEngine, repoConf.bucketName, keyRepo, objectID, offset, length)
+	} else {
+		r, err = repoConf.storageEngine.GetObject(req.Context(), repoConf.bucketName, keyRepo, objectID)
+	}
+	if err != nil {
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to read object")
+		return
+	}
+	defer r.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		log.Print(err)
+	}
+}
+
+// proxyUploadHandler streams the request body to the storage.
+// The body is hashed on the fly and the object is discarded when the hash doesn't match oid.
+func (server *Server) proxyUploadHandler(w http.ResponseWriter, req *http.Request, repoName, username, objectID string) {
+	repoConf := server.Repositories[repoName]
+	// The repository in the pool also accepts the upload which proves the possession of the content
+	if repoConf.proxy == false && repoConf.pool == "" {
+		writeError(w, req, http.StatusNotFound, "not found")
+		return
+	}
+	ow, err := repoConf.storageEngine.PutObject(req.Context(), repoConf.bucketName, repoName, objectID)
+	switch err {
+	case nil:
+	case storage.ErrInvalidObjectID:
+		writeError(w, req, http.StatusUnprocessableEntity, "invalid object id")
+		return
+	default:
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to write object")
+		return
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(ow, h), req.Body)
+	if err != nil {
+		log.Print(err)
+		storage.AbortWriter(ow, err)
+		writeError(w, req, http.StatusInternalServerError, "failed to write object")
+		return
+	}
+	if req.ContentLength >= 0 && n != req.ContentLength {
+		storage.AbortWriter(ow, errSizeMismatch)
+		writeError(w, req, http.StatusUnprocessableEntity, errSizeMismatch.Error())
+		return
+	}
+	if hex.EncodeToString(h.Sum(nil)) != objectID {
+		storage.AbortWriter(ow, errOidMismatch)
+		writeError(w, req, http.StatusUnprocessableEntity, errOidMismatch.Error())
+		return
+	}
+	if err := ow.Close(); err != nil {
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to write object")
+		return
+	}
+	if err := server.addReference(repoName, objectID); err != nil {
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to record reference")
+		return
+	}
+	recordUpload(repoName, username, objectID, n)
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,123 @@
+package lfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/database"
+)
+
+func TestProxy(t *testing.T) {
+	s, cleanup := newLocalTestServer(t, &config.RepositoryConfig{Mode: ModeProxy})
+	defer cleanup()
+
+	content := []byte("hello proxy world")
+	h := sha256.Sum256(content)
+	oid := hex.EncodeToString(h[:])
+	// The index outlives the test, so the downloads are counted from the current count
+	var downloads int64
+	if m, err := database.ReadObjectMetadata("f110/test1", oid); err == nil {
+		downloads = m.DownloadCount
+	}
+
+	t.Run("upload", func(t *testing.T) {
+		batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+			Operation: OperationUpload,
+			Transfers: []string{TransferTus, TransferBasic},
+			Objects:   []Object{{Oid: oid, Size: len(content)}},
+		})
+		if batchRes.Transfer != TransferBasic {
+			t.Errorf("unexpected transfer: %s", batchRes.Transfer)
+		}
+		upload := batchRes.Objects[0].Actions.Upload
+		if strings.HasPrefix(upload.Href, s.URL+"/f110/test1.git/info/lfs/objects/") == false {
+			t.Fatalf("href doesn't point to lfs server: %s", upload.Href)
+		}
+
+		res := doAction(t, http.MethodPut, upload.Href, upload.Header, []byte("corrupted content"))
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("corrupted content is accepted: %d", res.StatusCode)
+		}
+
+		res = doAction(t, http.MethodPut, upload.Href, upload.Header, content)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+	})
+
+	t.Run("download", func(t *testing.T) {
+		batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+			Operation: OperationDownload,
+			Objects:   []Object{{Oid: oid, Size: len(content)}},
+		})
+		download := batchRes.Objects[0].Actions.Download
+
+		res := doAction(t, http.MethodGet, download.Href, download.Header, nil)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != string(content) {
+			t.Errorf("unexpected response: %d %s", res.StatusCode, body)
+		}
+
+		header := map[string]string{"Range": "bytes=6-10"}
+		for k, v := range download.Header {
+			header[k] = v
+		}
+		res = doAction(t, http.MethodGet, download.Href, header, nil)
+		body, _ = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusPartialContent || string(body) != "proxy" {
+			t.Errorf("unexpected response: %d %s", res.StatusCode, body)
+		}
+		if res.Header.Get("Content-Range") != "bytes 6-10/17" {
+			t.Errorf("unexpected Content-Range: %s", res.Header.Get("Content-Range"))
+		}
+
+		res = doAction(t, http.MethodGet, download.Href, nil, nil)
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("download without credentials: %d", res.StatusCode)
+		}
+	})
+	t.Run("index", func(t *testing.T) {
+		m, err := database.ReadObjectMetadata("f110/test1", oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Uploader != "test-user" || m.Size != int64(len(content)) || m.UploadedAt.IsZero() {
+			t.Errorf("unexpected upload: %+v", m)
+		}
+		// The download action is counted, and the requests which transfer the object are not
+		if m.DownloadCount != downloads+1 || m.LastDownloadedAt.IsZero() {
+			t.Errorf("unexpected download: %+v", m)
+		}
+
+		usage, err := database.ReadRepositoryUsage("f110/test1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.Objects < 1 || usage.Size < int64(len(content)) {
+			t.Errorf("unexpected usage: %+v", usage)
+		}
+		objects, err := database.ReadObjectsUploadedBy("test-user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, v := range objects {
+			if v.ObjectID == oid {
+				found = true
+			}
+		}
+		if found == false {
+			t.Errorf("%s is not uploaded by test-user", oid)
+		}
+	})
+}
@@ -0,0 +1,482 @@
+package lfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/f110/git-lfs-cloud/database"
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+const (
+	TransferSSH             = "ssh"
+	SSHTransferVersion      = "version 1"
+	sshStatusOK             = 200
+	sshStatusCreated        = 201
+	sshStatusBadRequest     = 400
+	sshStatusForbidden      = 403
+	sshStatusNotFound       = 404
+	sshStatusConflict       = 409
+	sshStatusValidation     = 422
+	sshStatusInternalServer = 500
+)
+
+// transferRequest is the request of git-lfs-transfer protocol.
+type transferRequest struct {
+	Command string
+	Args    map[string]string
+	// HasData reports whether the data section follows the arguments
+	HasData bool
+}
+
+type sshTransfer struct {
+	server    *Server
+	p         *pktline
+	repoName  string
+	username  string
+	operation string
+}
+
+// ServeTransfer serves git-lfs-transfer protocol over rw.
+// ServeTransfer returns when the client quits or the connection is closed.
+func (server *Server) ServeTransfer(ctx context.Context, rw io.ReadWriter, repoName, username, operation string) error {
+	if _, ok := server.Repositories[repoName]; ok == false {
+		return fmt.Errorf("lfs: repository not found: %s", repoName)
+	}
+	t := &sshTransfer{server: server, p: newPktline(rw, rw), repoName: repoName, username: username, operation: operation}
+
+	// Capability advertisement
+	if err := t.p.writeLine("version=1"); err != nil {
+		return err
+	}
+	if err := t.p.writeFlush(); err != nil {
+		return err
+	}
+	req, err := t.readRequest()
+	if err != nil {
+		return err
+	}
+	if req.Command != SSHTransferVersion {
+		return t.writeError(sshStatusBadRequest, "unsupported version")
+	}
+	if err := t.writeStatus(sshStatusOK, nil, nil); err != nil {
+		return err
+	}
+
+	for {
+		req, err := t.readRequest()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		command := strings.SplitN(req.Command, " ", 2)
+		arg := ""
+		if len(command) == 2 {
+			arg = command[1]
+		}
+		switch command[0] {
+		case "quit":
+			return t.writeStatus(sshStatusOK, nil, nil)
+		case "batch":
+			err = t.batch(ctx, req)
+		case "get-object":
+			err = t.getObject(ctx, req, arg)
+		case "put-object":
+			err = t.putObject(ctx, req, arg)
+		case "verify-object":
+			err = t.verifyObject(ctx, req, arg)
+		case "lock":
+			err = t.lock(req)
+		case "list-lock":
+			err = t.listLock(req)
+		case "unlock":
+			err = t.unlock(req, arg)
+		default:
+			err = t.skipData(req)
+			if err == nil {
+				err = t.writeError(sshStatusBadRequest, "unknown command: "+command[0])
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (t *sshTransfer) readRequest() (*transferRequest, error) {
+	lines, last, err := t.p.readLines()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errInvalidPacket
+	}
+
+	req := &transferRequest{Command: lines[0], Args: make(map[string]string), HasData: last == pktDelim}
+	for _, l := range lines[1:] {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return nil, errInvalidPacket
+		}
+		req.Args[kv[0]] = kv[1]
+	}
+	return req, nil
+}
+
+// skipData discards the data section of req.
+func (t *sshTransfer) skipData(req *transferRequest) error {
+	if req.HasData == false {
+		return nil
+	}
+	_, err := io.Copy(ioutil.Discard, t.p.dataReader())
+	return err
+}
+
+func (t *sshTransfer) writeStatus(status int, args []string, data []string) error {
+	if err := t.p.writeLine(fmt.Sprintf("status %03d", status)); err != nil {
+		return err
+	}
+	for _, a := range args {
+		if err := t.p.writeLine(a); err != nil {
+			return err
+		}
+	}
+	if data != nil {
+		if err := t.p.writeDelim(); err != nil {
+			return err
+		}
+		for _, d := range data {
+			if err := t.p.writeLine(d); err != nil {
+				return err
+			}
+		}
+	}
+	return t.p.writeFlush()
+}
+
+func (t *sshTransfer) writeError(status int, message string) error {
+	return t.writeStatus(status, nil, []string{message})
+}
+
+func (t *sshTransfer) batch(ctx context.Context, req *transferRequest) error {
+	if req.HasData == false {
+		return t.writeError(sshStatusBadRequest, "objects are required")
+	}
+	lines, _, err := t.p.readLines()
+	if err != nil {
+		return err
+	}
+	if algo, ok := req.Args["hash-algo"]; ok && algo != "sha256" {
+		return t.writeError(sshStatusBadRequest, "unsupported hash algorithm: "+algo)
+	}
+	if len(lines) > t.server.maxBatchSize {
+		return t.writeError(sshStatusBadRequest, fmt.Sprintf("too many objects. the maximum is %d", t.server.maxBatchSize))
+	}
+
+	objects := make([]Object, 0, len(lines))
+	for _, l := range lines {
+		s := strings.Split(l, " ")
+		if len(s) != 2 {
+			return t.writeError(sshStatusBadRequest, "invalid object: "+l)
+		}
+		size, err := strconv.Atoi(s[1])
+		if err != nil || size < 0 {
+			return t.writeError(sshStatusBadRequest, "invalid object: "+l)
+		}
+		objects = append(objects, Object{Oid: s[0], Size: size})
+	}
+
+	_, adapter := t.server.selectTransfer(t.repoName, &BatchRequest{Operation: t.operation, Transfers: []string{TransferSSH}, Objects: objects, ssh: true})
+	if adapter == nil {
+		return t.writeError(sshStatusBadRequest, "no supported transfer adapter")
+	}
+
+	repoConf := t.server.Repositories[t.repoName]
+	ctx, cancel := context.WithTimeout(ctx, t.server.batchTimeout)
+	defer cancel()
+	results := t.server.processObjects(ctx, objects, func(ctx context.Context, o Object) Object {
+		if t.operation == OperationUpload && repoConf.pool != "" {
+			// put-object hashes the content, so the object which is not shared is just uploaded again
+			switch err := t.server.dedupObject(ctx, t.repoName, t.username, o); err {
+			case nil:
+				return o
+			case storage.ErrObjectNotExist:
+			case errNotShared:
+				o.Actions = &Action{Upload: &Upload{}}
+				return o
+			default:
+				log.Print(err)
+				o.Error = objectError(err)
+				return o
+			}
+		}
+		return adapter.Object(ctx, t.server, t.repoName, t.operation, o, "")
+	})
+	if ctx.Err() == context.DeadlineExceeded {
+		return t.writeError(sshStatusInternalServer, "batch request timed out")
+	}
+
+	data := make([]string, 0, len(results))
+	for _, o := range results {
+		action := "noop"
+		switch {
+		case o.Error != nil:
+			// The batch of the protocol can't carry the error of each object like the batch API,
+			// so the error is reported by get-object or put-object of the object and other objects are transferred.
+			action = t.operation
+		case o.Actions != nil && o.Actions.Upload != nil:
+			action = OperationUpload
+		case o.Actions != nil && o.Actions.Download != nil:
+			action = OperationDownload
+		}
+		data = append(data, fmt.Sprintf("%s %d %s", o.Oid, o.Size, action))
+	}
+	return t.writeStatus(sshStatusOK, []string{"transfer=basic"}, data)
+}
+
+func (t *sshTransfer) getObject(ctx context.Context, req *transferRequest, oid string) error {
+	if err := t.skipData(req); err != nil {
+		return err
+	}
+	repoConf := t.server.Repositories[t.repoName]
+	keyRepo, info, err := t.server.waitObject(ctx, t.repoName, oid)
+	switch err {
+	case nil:
+	case storage.ErrObjectNotExist, storage.ErrInvalidObjectID:
+		return t.writeError(sshStatusNotFound, "object not found")
+	default:
+		log.Print(err)
+		return t.writeError(sshStatusInternalServer, "failed to stat object")
+	}
+	r, err := repoConf.storageEngine.GetObject(ctx, repoConf.bucketName, keyRepo, oid)
+	if err != nil {
+		log.Print(err)
+		return t.writeError(sshStatusInternalServer, "failed to read object")
+	}
+	defer r.Close()
+
+	if err := t.p.writeLine(fmt.Sprintf("status %03d", sshStatusOK)); err != nil {
+		return err
+	}
+	if err := t.p.writeLine("size=" + strconv.FormatInt(info.Size, 10)); err != nil {
+		return err
+	}
+	if err := t.p.writeDelim(); err != nil {
+		return err
+	}
+	// The status is already sent, so the failure can only be told by closing the connection.
+	if _, err := io.CopyBuffer(t.p, r, make([]byte, pktMaxDataLen)); err != nil {
+		return err
+	}
+	return t.p.writeFlush()
+}
+
+// putObject stores the data section as the object. The content is hashed on the fly and
+// the object is discarded if either oid or size doesn't match.
+func (t *sshTransfer) putObject(ctx context.Context, req *transferRequest, oid string) error {
+	if t.operation != OperationUpload {
+		if err := t.skipData(req); err != nil {
+			return err
+		}
+		return t.writeError(sshStatusForbidden, "upload is not permitted")
+	}
+	size, err := strconv.ParseInt(req.Args["size"], 10, 64)
+	if err != nil || req.HasData == false {
+		if err := t.skipData(req); err != nil {
+			return err
+		}
+		return t.writeError(sshStatusBadRequest, "invalid size")
+	}
+
+	repoConf := t.server.Repositories[t.repoName]
+	w, err := repoConf.storageEngine.PutObject(ctx, repoConf.bucketName, t.repoName, oid)
+	if err != nil {
+		if err := t.skipData(req); err != nil {
+			return err
+		}
+		log.Print(err)
+		return t.writeError(sshStatusInternalServer, "failed to write object")
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), t.p.dataReader())
+	if err != nil {
+		storage.AbortWriter(w, err)
+		return err
+	}
+	if n != size {
+		storage.AbortWriter(w, errSizeMismatch)
+		return t.writeError(sshStatusValidation, errSizeMismatch.Error())
+	}
+	if hex.EncodeToString(h.Sum(nil)) != oid {
+		storage.AbortWriter(w, errOidMismatch)
+		return t.writeError(sshStatusValidation, errOidMismatch.Error())
+	}
+	if err := w.Close(); err != nil {
+		log.Print(err)
+		return t.writeError(sshStatusInternalServer, "failed to write object")
+	}
+	if err := t.server.addReference(t.repoName, oid); err != nil {
+		log.Print(err)
+		return t.writeError(sshStatusInternalServer, "failed to record reference")
+	}
+	recordUpload(t.repoName, t.username, oid, n)
+
+	return t.writeStatus(sshStatusOK, nil, nil)
+}
+
+func (t *sshTransfer) verifyObject(ctx context.Context, req *transferRequest, oid string) error {
+	if err := t.skipData(req); err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(req.Args["size"], 10, 64)
+	if err != nil {
+		return t.writeError(sshStatusBadRequest, "invalid size")
+	}
+
+	err = t.server.verifyObject(ctx, t.repoName, t.username, oid, size)
+	switch err {
+	case nil:
+	case storage.ErrObjectNotExist:
+		return t.writeError(sshStatusNotFound, "object not found")
+	case errSizeMismatch, errOidMismatch:
+		return t.writeError(sshStatusValidation, err.Error())
+	case errNotShared:
+		return t.writeError(sshStatusForbidden, err.Error())
+	default:
+		log.Print(err)
+		return t.writeError(sshStatusInternalServer, "failed to verify object")
+	}
+
+	return t.writeStatus(sshStatusOK, nil, nil)
+}
+
+func lockArgs(l *database.Lock) []string {
+	return []string{
+		"id=" + l.ID,
+		"path=" + l.Path,
+		"locked-at=" + l.LockedAt.Format(time.RFC3339),
+		"ownername=" + l.Owner,
+	}
+}
+
+func (t *sshTransfer) lock(req *transferRequest) error {
+	if err := t.skipData(req); err != nil {
+		return err
+	}
+	path := req.Args["path"]
+	if path == "" {
+		return t.writeError(sshStatusBadRequest, "path is required")
+	}
+
+	l, err := database.CreateLock(t.repoName, path, t.username)
+	switch err {
+	case nil:
+	case database.ErrLockExists:
+		return t.writeStatus(sshStatusConflict, lockArgs(l), []string{"already created lock"})
+	default:
+		log.Print(err)
+		return t.writeError(sshStatusInternalServer, "failed to create lock")
+	}
+
+	return t.writeStatus(sshStatusCreated, lockArgs(l), nil)
+}
+
+func (t *sshTransfer) listLock(req *transferRequest) error {
+	if err := t.skipData(req); err != nil {
+		return err
+	}
+	limit := 0
+	if v, ok := req.Args["limit"]; ok {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return t.writeError(sshStatusBadRequest, "invalid limit")
+		}
+		limit = i
+	}
+
+	locks, err := database.ReadLocks(t.repoName)
+	if err != nil {
+		log.Print(err)
+		return t.writeError(sshStatusInternalServer, "failed to read locks")
+	}
+	filtered := make([]*database.Lock, 0, len(locks))
+	for _, l := range locks {
+		if p := req.Args["path"]; p != "" && l.Path != p {
+			continue
+		}
+		if id := req.Args["id"]; id != "" && l.ID != id {
+			continue
+		}
+		filtered = append(filtered, l)
+	}
+
+	page, next := paginateLocks(filtered, req.Args["cursor"], limit)
+	var args []string
+	if next != "" {
+		args = append(args, "next-cursor="+next)
+	}
+	data := make([]string, 0, len(page)*5)
+	for _, l := range page {
+		owner := "theirs"
+		if l.Owner == t.username {
+			owner = "ours"
+		}
+		data = append(data,
+			"lock "+l.ID,
+			"path "+l.ID+" "+l.Path,
+			"locked-at "+l.ID+" "+l.LockedAt.Format(time.RFC3339),
+			"ownername "+l.ID+" "+l.Owner,
+			"owner "+l.ID+" "+owner,
+		)
+	}
+	return t.writeStatus(sshStatusOK, args, data)
+}
+
+func (t *sshTransfer) unlock(req *transferRequest, id string) error {
+	if err := t.skipData(req); err != nil {
+		return err
+	}
+
+	l, err := database.ReadLock(t.repoName, id)
+	switch err {
+	case nil:
+	case database.ErrNotFound:
+		return t.writeError(sshStatusNotFound, "lock not found")
+	default:
+		log.Print(err)
+		return t.writeError(sshStatusInternalServer, "failed to read lock")
+	}
+	if l.Owner != t.username {
+		if req.Args["force"] != "true" {
+			return t.writeError(sshStatusForbidden, "lock is owned by "+l.Owner)
+		}
+		if t.server.isAdmin(t.repoName, t.username) == false {
+			return t.writeError(sshStatusForbidden, "force unlock is permitted to admins only")
+		}
+		log.Printf("lfs: %s force-unlocked %s of %s in %s", t.username, l.Path, l.Owner, t.repoName)
+	}
+
+	err = database.DeleteLock(t.repoName, id)
+	switch err {
+	case nil:
+	case database.ErrNotFound:
+		return t.writeError(sshStatusNotFound, "lock not found")
+	default:
+		log.Print(err)
+		return t.writeError(sshStatusInternalServer, "failed to delete lock")
+	}
+
+	return t.writeStatus(sshStatusOK, lockArgs(l), nil)
+}
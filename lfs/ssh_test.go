@@ -0,0 +1,194 @@
+package lfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+type transferClient struct {
+	t *testing.T
+	p *pktline
+}
+
+func (c *transferClient) request(lines []string, data []string) {
+	for _, l := range lines {
+		if err := c.p.writeLine(l); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	if data != nil {
+		c.p.writeDelim()
+		for _, d := range data {
+			c.p.writeLine(d)
+		}
+	}
+	c.p.writeFlush()
+}
+
+// response returns the status line and arguments, and the data section if exists.
+func (c *transferClient) response() ([]string, []string) {
+	lines, last, err := c.p.readLines()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if last != pktDelim {
+		return lines, nil
+	}
+	data, _, err := c.p.readLines()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return lines, data
+}
+
+func TestServeTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serv, err := NewServer(&config.Config{URL: "http://localhost", Repositories: map[string]*config.RepositoryConfig{
+		"f110/test1": {Owner: "f110", Repo: "test1", Storage: "local", SigningKey: "test", Drivers: map[string]config.DriverConfig{"local": {"path": dir}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- serv.ServeTransfer(context.Background(), serverConn, "f110/test1", "test-user", OperationUpload)
+		serverConn.Close()
+	}()
+	defer clientConn.Close()
+	c := &transferClient{t: t, p: newPktline(clientConn, clientConn)}
+
+	capabilities, _ := c.response()
+	if len(capabilities) != 1 || capabilities[0] != "version=1" {
+		t.Fatalf("unexpected capabilities: %v", capabilities)
+	}
+	c.request([]string{"version 1"}, nil)
+	if res, _ := c.response(); res[0] != "status 200" {
+		t.Fatalf("unexpected response: %v", res)
+	}
+
+	content := bytes.Repeat([]byte("0123456789"), pktMaxDataLen/5)
+	h := sha256.Sum256(content)
+	oid := hex.EncodeToString(h[:])
+
+	t.Run("batch", func(t *testing.T) {
+		c.request([]string{"batch", "transfer=basic", "hash-algo=sha256"}, []string{fmt.Sprintf("%s %d", oid, len(content))})
+		res, data := c.response()
+		if res[0] != "status 200" {
+			t.Fatalf("unexpected response: %v", res)
+		}
+		if len(data) != 1 || data[0] != fmt.Sprintf("%s %d upload", oid, len(content)) {
+			t.Errorf("unexpected objects: %v", data)
+		}
+	})
+
+	t.Run("batch_with_invalid_object", func(t *testing.T) {
+		c.request([]string{"batch", "transfer=basic", "hash-algo=sha256"}, []string{"invalid 1", fmt.Sprintf("%s %d", oid, len(content))})
+		res, data := c.response()
+		if res[0] != "status 200" {
+			t.Fatalf("the batch is failed by the invalid object: %v", res)
+		}
+		if len(data) != 2 || data[0] != "invalid 1 upload" || data[1] != fmt.Sprintf("%s %d upload", oid, len(content)) {
+			t.Errorf("unexpected objects: %v", data)
+		}
+
+		c.p.writeLine("put-object invalid")
+		c.p.writeLine("size=1")
+		c.p.writeDelim()
+		c.p.Write([]byte("a"))
+		c.p.writeFlush()
+		if res, _ := c.response(); res[0] == "status 200" {
+			t.Errorf("the invalid object is accepted: %v", res)
+		}
+	})
+
+	t.Run("put-object", func(t *testing.T) {
+		send := func(b []byte) []string {
+			c.p.writeLine("put-object " + oid)
+			c.p.writeLine(fmt.Sprintf("size=%d", len(content)))
+			c.p.writeDelim()
+			c.p.Write(b)
+			c.p.writeFlush()
+			res, _ := c.response()
+			return res
+		}
+
+		if res := send(content[:len(content)-1]); res[0] != "status 422" {
+			t.Errorf("truncated object is accepted: %v", res)
+		}
+		if res := send(content); res[0] != "status 200" {
+			t.Fatalf("unexpected response: %v", res)
+		}
+
+		c.request([]string{"verify-object " + oid, fmt.Sprintf("size=%d", len(content))}, nil)
+		if res, _ := c.response(); res[0] != "status 200" {
+			t.Errorf("unexpected response: %v", res)
+		}
+	})
+
+	t.Run("get-object", func(t *testing.T) {
+		c.request([]string{"get-object " + oid}, nil)
+		res, _, err := c.p.readLines()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0] != "status 200" || res[1] != fmt.Sprintf("size=%d", len(content)) {
+			t.Fatalf("unexpected response: %v", res)
+		}
+		buf, err := ioutil.ReadAll(c.p.dataReader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(buf, content) == false {
+			t.Error("unexpected content")
+		}
+	})
+
+	t.Run("lock", func(t *testing.T) {
+		c.request([]string{"lock", "path=ssh/foo.psd"}, nil)
+		res, _ := c.response()
+		if res[0] != "status 201" {
+			t.Fatalf("unexpected response: %v", res)
+		}
+		id := strings.TrimPrefix(res[1], "id=")
+
+		c.request([]string{"lock", "path=ssh/foo.psd"}, nil)
+		if res, _ := c.response(); res[0] != "status 409" {
+			t.Errorf("unexpected response: %v", res)
+		}
+
+		c.request([]string{"list-lock", "path=ssh/foo.psd"}, nil)
+		res, data := c.response()
+		if res[0] != "status 200" || len(data) != 5 || data[4] != "owner "+id+" ours" {
+			t.Errorf("unexpected response: %v %v", res, data)
+		}
+
+		c.request([]string{"unlock " + id}, nil)
+		if res, _ := c.response(); res[0] != "status 200" {
+			t.Errorf("unexpected response: %v", res)
+		}
+	})
+
+	c.request([]string{"quit"}, nil)
+	if res, _ := c.response(); res[0] != "status 200" {
+		t.Errorf("unexpected response: %v", res)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
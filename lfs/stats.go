@@ -0,0 +1,22 @@
+package lfs
+
+import (
+	"fmt"
+
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+// CacheStats returns the accounting of the cache of the repository which uses cached storage.
+func (server *Server) CacheStats(repoName string) (storage.CacheStats, error) {
+	repoConf, ok := server.Repositories[repoName]
+	if ok == false {
+		return storage.CacheStats{}, fmt.Errorf("lfs: %s is not found", repoName)
+	}
+	cached, ok := repoConf.storageEngine.(interface {
+		Stats() storage.CacheStats
+	})
+	if ok == false {
+		return storage.CacheStats{}, fmt.Errorf("lfs: %s doesn't use cached storage", repoName)
+	}
+	return cached.Stats(), nil
+}
@@ -0,0 +1,64 @@
+package lfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+func TestCacheStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serv, err := NewServer(&config.Config{Repositories: map[string]*config.RepositoryConfig{
+		"f110/test1": {
+			Owner:      "f110",
+			Repo:       "test1",
+			Storage:    "cached",
+			SigningKey: "test",
+			Drivers:    map[string]config.DriverConfig{"cached": {"path": filepath.Join(dir, "cache"), "cache_size": 1024}},
+			Backend:    &config.RepositoryConfig{Storage: "local", Drivers: map[string]config.DriverConfig{"local": {"path": filepath.Join(dir, "backend")}}},
+		},
+		"f110/test2": {Owner: "f110", Repo: "test2", Storage: "local", SigningKey: "test", Drivers: map[string]config.DriverConfig{"local": {"path": filepath.Join(dir, "test2")}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objectID := "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+	engine := serv.Repositories["f110/test1"].storageEngine
+	w, err := engine.PutObject(context.Background(), "", "f110/test1", objectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello world"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		r, err := engine.GetObject(context.Background(), "", "f110/test1", objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+
+	stats, err := serv.CacheStats("f110/test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Misses != 1 || stats.Hits != 1 || stats.Objects != 1 || stats.Size != 11 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if _, err := serv.CacheStats("f110/test2"); err == nil {
+		t.Error("the repository which doesn't use cached storage has stats")
+	}
+}
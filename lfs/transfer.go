@@ -0,0 +1,214 @@
+package lfs
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+const (
+	TransferBasic     = storage.TransferBasic
+	TransferMultipart = storage.TransferMultipart
+	TransferTus       = storage.TransferTus
+)
+
+// TransferAdapter builds the actions of each object for the transfer.
+type TransferAdapter interface {
+	// Accept reports whether the adapter can handle the batch request.
+	Accept(server *Server, repoName string, batchReq *BatchRequest) bool
+	Object(ctx context.Context, server *Server, repoName string, operation string, o Object, authorization string) Object
+}
+
+type transferAdapter struct {
+	name     string
+	priority int
+	adapter  TransferAdapter
+}
+
+var (
+	transferAdaptersMu sync.RWMutex
+	transferAdapters   = make(map[string]*transferAdapter)
+)
+
+// RegisterTransferAdapter registers the adapter by name.
+// When several adapters are available, the adapter which has the highest priority is used.
+func RegisterTransferAdapter(name string, priority int, adapter TransferAdapter) {
+	transferAdaptersMu.Lock()
+	defer transferAdaptersMu.Unlock()
+	transferAdapters[name] = &transferAdapter{name: name, priority: priority, adapter: adapter}
+}
+
+func init() {
+	RegisterTransferAdapter(TransferBasic, 0, basicTransfer{})
+	RegisterTransferAdapter(TransferTus, 10, tusTransfer{})
+	RegisterTransferAdapter(TransferMultipart, 20, multipartTransfer{})
+	RegisterTransferAdapter(TransferSSH, 0, sshTransferAdapter{})
+}
+
+// selectTransfer picks the best adapter which both the client and the storage support.
+func (server *Server) selectTransfer(repoName string, batchReq *BatchRequest) (string, TransferAdapter) {
+	clientTransfers := batchReq.Transfers
+	if len(clientTransfers) == 0 {
+		clientTransfers = []string{TransferBasic}
+	}
+	storageTransfers := make(map[string]bool)
+	if batchReq.ssh {
+		// Objects are transferred over the SSH connection regardless of the storage
+		storageTransfers[TransferSSH] = true
+	} else if server.Repositories[repoName].proxy || server.Repositories[repoName].pool != "" {
+		// lfs server transfers objects by itself.
+		// The repository in the pool may have to receive the object through lfs server to share it.
+		storageTransfers[TransferBasic] = true
+	} else {
+		for _, t := range storage.TransferAdapters(server.Repositories[repoName].storageEngine) {
+			storageTransfers[t] = true
+		}
+	}
+
+	candidates := make([]*transferAdapter, 0)
+	for _, name := range clientTransfers {
+		transferAdaptersMu.RLock()
+		t, ok := transferAdapters[name]
+		transferAdaptersMu.RUnlock()
+		if ok == false || storageTransfers[name] == false {
+			continue
+		}
+		if t.adapter.Accept(server, repoName, batchReq) == false {
+			continue
+		}
+		candidates = append(candidates, t)
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].priority > candidates[j].priority
+	})
+
+	return candidates[0].name, candidates[0].adapter
+}
+
+type basicTransfer struct{}
+
+func (basicTransfer) Accept(_ *Server, _ string, _ *BatchRequest) bool {
+	return true
+}
+
+func (basicTransfer) Object(ctx context.Context, server *Server, repoName string, operation string, o Object, authorization string) Object {
+	if server.Repositories[repoName].proxy {
+		return server.operationProxy(ctx, repoName, operation, o, authorization)
+	}
+	switch operation {
+	case OperationDownload:
+		return server.operationDownload(ctx, repoName, o, authorization)
+	case OperationUpload:
+		return server.operationUpload(ctx, repoName, o, authorization)
+	}
+	return o
+}
+
+type multipartTransfer struct{}
+
+// Accept accepts the upload which has at least one object larger than the threshold.
+func (multipartTransfer) Accept(server *Server, repoName string, batchReq *BatchRequest) bool {
+	if batchReq.Operation != OperationUpload {
+		return false
+	}
+	repoConf := server.Repositories[repoName]
+	if _, ok := repoConf.storageEngine.(storage.MultipartStorage); ok == false {
+		return false
+	}
+	for _, o := range batchReq.Objects {
+		if int64(o.Size) >= repoConf.multipartThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+func (multipartTransfer) Object(ctx context.Context, server *Server, repoName string, _ string, o Object, authorization string) Object {
+	return server.operationMultipartUpload(ctx, repoName, o, authorization)
+}
+
+type tusTransfer struct{}
+
+func (tusTransfer) Accept(server *Server, repoName string, batchReq *BatchRequest) bool {
+	if batchReq.Operation != OperationUpload {
+		return false
+	}
+	_, ok := server.Repositories[repoName].storageEngine.(storage.ResumableStorage)
+	return ok
+}
+
+func (tusTransfer) Object(ctx context.Context, server *Server, repoName string, _ string, o Object, authorization string) Object {
+	repoConf := server.Repositories[repoName]
+	info, err := repoConf.storageEngine.Stat(ctx, repoConf.bucketName, repoName, o.Oid)
+	if err == nil && info.Size == int64(o.Size) {
+		// The object is already uploaded
+		return Object{Oid: o.Oid, Size: o.Size, Autheticated: true}
+	}
+	if err != nil && err != storage.ErrObjectNotExist {
+		log.Print(err)
+		return Object{Oid: o.Oid, Size: o.Size, Error: objectError(err)}
+	}
+
+	expiresIn, expiresAt := repoConf.expiration()
+	u, err := repoConf.storageEngine.(storage.ResumableStorage).PutResumable(ctx, repoConf.bucketName, repoName, o.Oid, int64(o.Size))
+	if err != nil {
+		log.Print(err)
+		return Object{Oid: o.Oid, Size: o.Size, Error: objectError(err)}
+	}
+	return Object{
+		Oid:          o.Oid,
+		Size:         o.Size,
+		Autheticated: true,
+		Actions: &Action{
+			Upload: &Upload{Href: u, ExpiresIn: expiresIn, ExpiresAt: expiresAt, Header: map[string]string{"Tus-Resumable": storage.TusVersion}},
+			Verify: &Verify{
+				Href:      server.baseURL + "/" + repoName + ".git/info/lfs/verify",
+				Header:    map[string]string{"Authorization": authorization},
+				ExpiresIn: expiresIn,
+				ExpiresAt: expiresAt,
+			},
+		},
+	}
+}
+
+// sshTransferAdapter transfers objects by get-object and put-object of git-lfs-transfer protocol.
+// The action of each object has no href because the object is sent over the SSH connection.
+type sshTransferAdapter struct{}
+
+func (sshTransferAdapter) Accept(_ *Server, _ string, batchReq *BatchRequest) bool {
+	return batchReq.ssh
+}
+
+func (sshTransferAdapter) Object(ctx context.Context, server *Server, repoName string, operation string, o Object, _ string) Object {
+	repoConf := server.Repositories[repoName]
+	var info *storage.ObjectInfo
+	var err error
+	if operation == OperationDownload {
+		_, info, err = server.locateObject(ctx, repoName, o.Oid, int64(o.Size))
+	} else {
+		info, err = repoConf.storageEngine.Stat(ctx, repoConf.bucketName, repoName, o.Oid)
+	}
+	switch err {
+	case nil, errFetching:
+		if operation == OperationUpload && info.Size != int64(o.Size) {
+			o.Actions = &Action{Upload: &Upload{}}
+		} else if operation == OperationDownload {
+			o.Actions = &Action{Download: &Download{}}
+			recordDownload(repoName, o.Oid, info.Size)
+		}
+	case storage.ErrObjectNotExist:
+		if operation == OperationUpload {
+			o.Actions = &Action{Upload: &Upload{}}
+		}
+	default:
+		log.Print(err)
+		o.Error = objectError(err)
+	}
+	return o
+}
@@ -0,0 +1,124 @@
+package lfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+func TestTransferNegotiation(t *testing.T) {
+	s, cleanup := newLocalTestServer(t, &config.RepositoryConfig{})
+	defer cleanup()
+
+	content := []byte("hello tus world")
+	h := sha256.Sum256(content)
+	oid := hex.EncodeToString(h[:])
+
+	t.Run("default", func(t *testing.T) {
+		batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+			Operation: OperationDownload,
+			Objects:   []Object{{Oid: oid, Size: len(content)}},
+		})
+		if batchRes.Transfer != TransferBasic {
+			t.Errorf("unexpected transfer: %s", batchRes.Transfer)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		reqBody, err := json.Marshal(&BatchRequest{
+			Operation: OperationUpload,
+			Transfers: []string{TransferMultipart},
+			Objects:   []Object{{Oid: oid, Size: len(content)}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := doAction(t, http.MethodPost, s.URL+"/f110/test1.git/info/lfs/objects/batch", map[string]string{"Authorization": "Bearer for-test"}, reqBody)
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("unexpected status code: %d", res.StatusCode)
+		}
+	})
+
+	t.Run("ssh_over_http", func(t *testing.T) {
+		reqBody, err := json.Marshal(&BatchRequest{
+			Operation: OperationDownload,
+			Transfers: []string{TransferSSH},
+			Objects:   []Object{{Oid: oid, Size: len(content)}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := doAction(t, http.MethodPost, s.URL+"/f110/test1.git/info/lfs/objects/batch", map[string]string{"Authorization": "Bearer for-test"}, reqBody)
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("ssh adapter is selected over HTTP: %d", res.StatusCode)
+		}
+	})
+
+	t.Run("tus", func(t *testing.T) {
+		batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+			Operation: OperationUpload,
+			Transfers: []string{TransferBasic, TransferTus},
+			Objects:   []Object{{Oid: oid, Size: len(content)}},
+		})
+		if batchRes.Transfer != TransferTus {
+			t.Fatalf("unexpected transfer: %s", batchRes.Transfer)
+		}
+		upload := batchRes.Objects[0].Actions.Upload
+
+		patch := func(offset int, body []byte) *http.Response {
+			header := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": strconv.Itoa(offset)}
+			for k, v := range upload.Header {
+				header[k] = v
+			}
+			return doAction(t, http.MethodPatch, upload.Href, header, body)
+		}
+
+		res := patch(0, content[:5])
+		res.Body.Close()
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+
+		res = doAction(t, http.MethodHead, upload.Href, upload.Header, nil)
+		res.Body.Close()
+		if res.Header.Get("Upload-Offset") != "5" {
+			t.Fatalf("unexpected offset: %s", res.Header.Get("Upload-Offset"))
+		}
+
+		res = patch(3, content[3:])
+		res.Body.Close()
+		if res.StatusCode != http.StatusConflict {
+			t.Errorf("mismatched offset is accepted: %d", res.StatusCode)
+		}
+
+		res = patch(5, content[5:])
+		res.Body.Close()
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+
+		batchRes = doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+			Operation: OperationDownload,
+			Transfers: []string{TransferTus, TransferBasic},
+			Objects:   []Object{{Oid: oid, Size: len(content)}},
+		})
+		if batchRes.Transfer != TransferBasic {
+			t.Errorf("unexpected transfer for download: %s", batchRes.Transfer)
+		}
+		res = doAction(t, http.MethodGet, batchRes.Objects[0].Actions.Download.Href, nil, nil)
+		defer res.Body.Close()
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(res.Body)
+		if bytes.Equal(buf.Bytes(), content) == false {
+			t.Errorf("unexpected content: %s", buf.String())
+		}
+	})
+}
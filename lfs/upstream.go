@@ -0,0 +1,131 @@
+package lfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+// fetchUpstream starts to copy the object from the upstream LFS server into the storage of the repository.
+// size is the size which the client requested. If size is 0, the size in the response of the upstream is used.
+func (server *Server) fetchUpstream(ctx context.Context, repoName, oid string, size int64) error {
+	if server.isFetching(repoName, oid) {
+		return nil
+	}
+	o, err := upstreamDownloadAction(ctx, server.Repositories[repoName].upstream, oid, size)
+	if err != nil {
+		return err
+	}
+	server.startFetch(repoName, oid, func(ctx context.Context) error {
+		return server.copyUpstream(ctx, repoName, o)
+	})
+	return nil
+}
+
+// copyUpstream copies the object by the download action of the upstream.
+// The content is hashed while copying, and the object is discarded if it doesn't match oid.
+func (server *Server) copyUpstream(ctx context.Context, repoName string, o *Object) error {
+	repoConf := server.Repositories[repoName]
+	req, err := http.NewRequest(http.MethodGet, o.Actions.Download.Href, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range o.Actions.Download.Header {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("lfs: failed to download %s from upstream: %s", o.Oid, res.Status)
+	}
+
+	w, err := repoConf.storageEngine.PutObject(ctx, repoConf.bucketName, repoName, o.Oid)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(res.Body, int64(o.Size)+1))
+	if err == nil && n != int64(o.Size) {
+		err = errSizeMismatch
+	}
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != o.Oid {
+		err = errOidMismatch
+	}
+	if err != nil {
+		storage.AbortWriter(w, err)
+		return fmt.Errorf("lfs: failed to copy %s from upstream: %v", o.Oid, err)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return server.addReference(repoName, o.Oid)
+}
+
+// upstreamDownloadAction requests the download action of the object by the batch API of the upstream.
+// If size is 0, the size is unknown and the size in the response is used.
+func upstreamDownloadAction(ctx context.Context, upstream *config.UpstreamConfig, oid string, size int64) (*Object, error) {
+	body, err := json.Marshal(&BatchRequest{
+		Operation: OperationDownload,
+		Transfers: []string{storage.TransferBasic},
+		Objects:   []Object{{Oid: oid, Size: int(size)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(upstream.URL, "/")+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("Accept", ContentType)
+	if upstream.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+upstream.Token)
+	} else if upstream.Username != "" {
+		req.SetBasicAuth(upstream.Username, upstream.Password)
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lfs: upstream batch request failed: %s", res.Status)
+	}
+	batchRes := &BatchResponse{}
+	if err := json.NewDecoder(res.Body).Decode(batchRes); err != nil {
+		return nil, err
+	}
+
+	for _, o := range batchRes.Objects {
+		if o.Oid != oid {
+			continue
+		}
+		if o.Error != nil {
+			if o.Error.Code == ErrorCodeNotExist {
+				return nil, storage.ErrObjectNotExist
+			}
+			return nil, fmt.Errorf("lfs: upstream returned the error of %s: %d %s", oid, o.Error.Code, o.Error.Message)
+		}
+		if o.Actions == nil || o.Actions.Download == nil {
+			return nil, fmt.Errorf("lfs: upstream returned no download action of %s", oid)
+		}
+		if size > 0 {
+			o.Size = int(size)
+		}
+		return &o, nil
+	}
+	return nil, storage.ErrObjectNotExist
+}
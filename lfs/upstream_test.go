@@ -0,0 +1,126 @@
+package lfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+// newUpstreamServer returns the stand-in of the upstream LFS server which serves objects.
+// The size in the response is the size of the request as well as lfs server. The download waits until release is closed.
+func newUpstreamServer(objects map[string]string, batchRequests *int32, release <-chan struct{}) *httptest.Server {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer upstream-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case req.URL.Path == "/f110/test1.git/info/lfs/objects/batch" && req.Method == http.MethodPost:
+			atomic.AddInt32(batchRequests, 1)
+			batchReq := &BatchRequest{}
+			if err := json.NewDecoder(req.Body).Decode(batchReq); err != nil || batchReq.Operation != OperationDownload {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+			batchRes := &BatchResponse{Transfer: TransferBasic}
+			for _, o := range batchReq.Objects {
+				_, ok := objects[o.Oid]
+				if ok == false {
+					batchRes.Objects = append(batchRes.Objects, Object{Oid: o.Oid, Error: &Error{Code: ErrorCodeNotExist, Message: "not found"}})
+					continue
+				}
+				batchRes.Objects = append(batchRes.Objects, Object{
+					Oid:  o.Oid,
+					Size: o.Size,
+					Actions: &Action{
+						Download: &Download{Href: s.URL + "/download/" + o.Oid, Header: map[string]string{"Authorization": "Bearer upstream-token"}},
+					},
+				})
+			}
+			w.Header().Set("Content-Type", ContentType)
+			json.NewEncoder(w).Encode(batchRes)
+		case strings.HasPrefix(req.URL.Path, "/download/") && req.Method == http.MethodGet:
+			<-release
+			content, ok := objects[strings.TrimPrefix(req.URL.Path, "/download/")]
+			if ok == false {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(content))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return s
+}
+
+func TestUpstream(t *testing.T) {
+	content := "hello upstream world"
+	h := sha256.Sum256([]byte(content))
+	oid := hex.EncodeToString(h[:])
+	corruptedOid := "2222222222222222222222222222222222222222222222222222222222222222"
+	missingOid := "1111111111111111111111111111111111111111111111111111111111111111"
+
+	var batchRequests int32
+	release := make(chan struct{})
+	upstream := newUpstreamServer(map[string]string{oid: content, corruptedOid: "corrupted"}, &batchRequests, release)
+	defer upstream.Close()
+	s, cleanup := newLocalTestServer(t, &config.RepositoryConfig{
+		Upstream: &config.UpstreamConfig{URL: upstream.URL + "/f110/test1.git/info/lfs", Token: "upstream-token"},
+	})
+	defer cleanup()
+
+	batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+		Operation: OperationDownload,
+		Objects:   []Object{{Oid: oid, Size: len(content)}, {Oid: corruptedOid, Size: 9}, {Oid: missingOid, Size: 1}},
+	})
+	if len(batchRes.Objects) != 3 {
+		t.Fatalf("Response: objects length is mismatch: %d", len(batchRes.Objects))
+	}
+	// The batch request doesn't wait for the copy, and the object is served through lfs server
+	for _, o := range batchRes.Objects[:2] {
+		if o.Error != nil || o.Actions == nil || strings.HasPrefix(o.Actions.Download.Href, s.URL+"/f110/test1.git/info/lfs/objects/") == false {
+			t.Fatalf("object in the upstream is not downloadable through lfs server: %v", o)
+		}
+	}
+	if batchRes.Objects[2].Error == nil || batchRes.Objects[2].Error.Code != ErrorCodeNotExist {
+		t.Errorf("missing object does not have error: %v", batchRes.Objects[2])
+	}
+	close(release)
+
+	download := batchRes.Objects[0].Actions.Download
+	res := doAction(t, http.MethodGet, download.Href, download.Header, nil)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != content {
+		t.Errorf("unexpected response: %d %s", res.StatusCode, body)
+	}
+	download = batchRes.Objects[1].Actions.Download
+	res = doAction(t, http.MethodGet, download.Href, download.Header, nil)
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("corrupted object is accepted: %d", res.StatusCode)
+	}
+
+	// The copied object is served from the storage
+	n := atomic.LoadInt32(&batchRequests)
+	batchRes = doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+		Operation: OperationDownload,
+		Objects:   []Object{{Oid: oid, Size: len(content)}},
+	})
+	if batchRes.Objects[0].Error != nil || strings.HasPrefix(batchRes.Objects[0].Actions.Download.Href, s.URL+"/f110/test1.git/") {
+		t.Errorf("copied object is not downloaded from the storage: %v", batchRes.Objects[0])
+	}
+	if atomic.LoadInt32(&batchRequests) != n {
+		t.Error("copied object is fetched from the upstream again")
+	}
+}
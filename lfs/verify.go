@@ -0,0 +1,104 @@
+package lfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/f110/git-lfs-cloud/storage"
+)
+
+var (
+	errSizeMismatch = errors.New("size mismatch")
+	errOidMismatch  = errors.New("oid mismatch")
+)
+
+// verifyHandler checks the uploaded object has the requested size.
+// If verify_content is enabled, the content is also hashed and compared with oid.
+func (server *Server) verifyHandler(w http.ResponseWriter, req *http.Request, repoName, username string) {
+	var obj Object
+	err := json.NewDecoder(req.Body).Decode(&obj)
+	if err != nil || obj.Oid == "" {
+		writeError(w, req, http.StatusUnprocessableEntity, "invalid request")
+		return
+	}
+
+	err = server.verifyObject(req.Context(), repoName, username, obj.Oid, int64(obj.Size))
+	switch err {
+	case nil:
+	case storage.ErrObjectNotExist:
+		writeError(w, req, http.StatusNotFound, "object not found")
+		return
+	case errSizeMismatch, errOidMismatch:
+		writeError(w, req, http.StatusUnprocessableEntity, err.Error())
+		return
+	case errNotShared:
+		writeError(w, req, http.StatusForbidden, err.Error())
+		return
+	default:
+		log.Print(err)
+		writeError(w, req, http.StatusInternalServerError, "failed to verify object")
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusOK)
+}
+
+// verifyObject returns errSizeMismatch or errOidMismatch if the stored object doesn't match oid and size.
+// The mismatched object is deleted so that nobody downloads it and the client can upload it again.
+// But the object whose content matches oid is kept even if the size is mismatched, because the requested size is wrong.
+// The verified object is referred by the repository if the repository is in the pool and the object is shared with the user.
+// The content of the object in the pool is always hashed because the object is shared by other repositories.
+// The verified object is recorded in the object index as uploaded by username.
+func (server *Server) verifyObject(ctx context.Context, repoName, username, oid string, size int64) error {
+	repoConf := server.Repositories[repoName]
+
+	info, err := repoConf.storageEngine.Stat(ctx, repoConf.bucketName, repoName, oid)
+	if err != nil {
+		return err
+	}
+
+	hashed := repoConf.verifyContent || repoConf.pool != ""
+	if hashed {
+		r, err := repoConf.storageEngine.GetObject(ctx, repoConf.bucketName, repoName, oid)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != oid {
+			server.deleteObject(ctx, repoName, oid)
+			return errOidMismatch
+		}
+	}
+	if info.Size != size {
+		if hashed == false {
+			server.deleteObject(ctx, repoName, oid)
+		}
+		return errSizeMismatch
+	}
+
+	if err := server.claimReference(repoName, username, oid); err != nil {
+		return err
+	}
+	recordUpload(repoName, username, oid, size)
+	return nil
+}
+
+// deleteObject deletes the object which is failed to verify. The error is only logged because the verification has failed anyway.
+func (server *Server) deleteObject(ctx context.Context, repoName, oid string) {
+	repoConf := server.Repositories[repoName]
+	if err := repoConf.storageEngine.Delete(ctx, repoConf.bucketName, repoName, oid); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,66 @@
+package lfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+func TestVerify(t *testing.T) {
+	content := []byte("hello world")
+	h := sha256.Sum256(content)
+	oid := hex.EncodeToString(h[:])
+	corruptedOid := "0000000000000000000000000000000000000000000000000000000000000000"
+
+	s, cleanup := newLocalTestServer(t, &config.RepositoryConfig{VerifyContent: true})
+	defer cleanup()
+
+	batchRes := doBatchRequest(t, s.URL, "f110/test1", "for-test", &BatchRequest{
+		Operation: OperationUpload,
+		Objects:   []Object{{Oid: oid, Size: len(content)}, {Oid: corruptedOid, Size: len(content)}},
+	})
+	if len(batchRes.Objects) != 2 {
+		t.Fatalf("Response: objects length is mismatch: %d", len(batchRes.Objects))
+	}
+	for _, o := range batchRes.Objects {
+		if o.Actions.Upload == nil || o.Actions.Verify == nil {
+			t.Fatalf("Response: upload or verify action is not found: %v", o.Actions)
+		}
+		res := doAction(t, http.MethodPut, o.Actions.Upload.Href, o.Actions.Upload.Header, content)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("failed to upload: %d", res.StatusCode)
+		}
+	}
+	verify := batchRes.Objects[0].Actions.Verify
+
+	cases := []struct {
+		Name       string
+		Object     Object
+		StatusCode int
+	}{
+		{Name: "ok", Object: Object{Oid: oid, Size: len(content)}, StatusCode: http.StatusOK},
+		{Name: "size_mismatch", Object: Object{Oid: oid, Size: len(content) + 1}, StatusCode: http.StatusUnprocessableEntity},
+		{Name: "not_deleted", Object: Object{Oid: oid, Size: len(content)}, StatusCode: http.StatusOK},
+		{Name: "oid_mismatch", Object: Object{Oid: corruptedOid, Size: len(content)}, StatusCode: http.StatusUnprocessableEntity},
+		{Name: "deleted", Object: Object{Oid: corruptedOid, Size: len(content)}, StatusCode: http.StatusNotFound},
+		{Name: "not_found", Object: Object{Oid: "1111111111111111111111111111111111111111111111111111111111111111", Size: 1}, StatusCode: http.StatusNotFound},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			body, err := json.Marshal(c.Object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := doAction(t, http.MethodPost, verify.Href, verify.Header, body)
+			res.Body.Close()
+			if res.StatusCode != c.StatusCode {
+				t.Errorf("unexpected status code: %d", res.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,397 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+const (
+	// azureAPIVersion is 2019-12-12 or later because older versions limit the size of Put Blob to 256 MiB.
+	// The string-to-sign of the service SAS changes in 2020-12-06.
+	azureAPIVersion       = "2019-12-12"
+	azureDefaultBlockSize = 8 * 1024 * 1024
+	azureTimeFormat       = "2006-01-02T15:04:05Z"
+)
+
+// AzureBlobStorage stores objects in Azure Blob Storage.
+// All requests, including requests from lfs server itself, are authorized by the service SAS.
+type AzureBlobStorage struct {
+	client    *http.Client
+	endpoint  string
+	account   string
+	key       []byte
+	container string
+	expire    time.Duration
+	blockSize int64
+	layout    *KeyLayout
+}
+
+// azureConfig is the section of azure driver.
+type azureConfig struct {
+	Account    string
+	AccountKey string `toml:"account_key"`
+	// ConnectionString is used instead of Account and AccountKey if it is specified
+	ConnectionString string `toml:"connection_string"`
+	Container        string
+	// PartSize is the size of each block which is uploaded by PutObject
+	PartSize int64 `toml:"part_size"`
+}
+
+func init() {
+	Register("azure", func(_ *config.Config, repoConf *config.RepositoryConfig, driverConf config.DriverConfig) (Storage, error) {
+		var c azureConfig
+		if err := driverConf.Decode(&c); err != nil {
+			return nil, err
+		}
+		account, key, endpoint := c.Account, c.AccountKey, ""
+		if c.ConnectionString != "" {
+			var err error
+			account, key, endpoint, err = parseAzureConnectionString(c.ConnectionString)
+			if err != nil {
+				return nil, err
+			}
+		}
+		azure, err := NewAzureBlobStorage(account, key, endpoint, c.Container, urlExpire(repoConf), c.PartSize)
+		if err != nil {
+			return nil, err
+		}
+		azure.layout, err = newKeyLayout(repoConf.KeyLayout, azure.layout)
+		return azure, err
+	})
+}
+
+// NewAzureBlobStorage returns the storage of the account. If endpoint is empty, the endpoint of Azure public cloud is used.
+func NewAzureBlobStorage(account, accountKey, endpoint, container string, expire time.Duration, blockSize int64) (*AzureBlobStorage, error) {
+	if account == "" {
+		return nil, errors.New("account is required")
+	}
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil || len(key) == 0 {
+		return nil, errors.New("invalid account key")
+	}
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	if blockSize <= 0 {
+		blockSize = azureDefaultBlockSize
+	}
+
+	return &AzureBlobStorage{
+		client:    http.DefaultClient,
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		account:   account,
+		key:       key,
+		container: container,
+		expire:    expire,
+		blockSize: blockSize,
+		layout:    &KeyLayout{},
+	}, nil
+}
+
+// parseAzureConnectionString returns the account name, the account key and the blob endpoint.
+func parseAzureConnectionString(s string) (string, string, string, error) {
+	values := make(map[string]string)
+	for _, kv := range strings.Split(s, ";") {
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return "", "", "", fmt.Errorf("invalid connection string: %s", kv)
+		}
+		values[kv[:i]] = kv[i+1:]
+	}
+	if values["AccountName"] == "" || values["AccountKey"] == "" {
+		return "", "", "", errors.New("AccountName and AccountKey are required in connection string")
+	}
+
+	endpoint := values["BlobEndpoint"]
+	if endpoint == "" {
+		protocol := values["DefaultEndpointsProtocol"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		suffix := values["EndpointSuffix"]
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		endpoint = protocol + "://" + values["AccountName"] + ".blob." + suffix
+	}
+	return values["AccountName"], values["AccountKey"], endpoint, nil
+}
+
+func (azure *AzureBlobStorage) containerName(bucketName string) string {
+	if azure.container != "" {
+		return azure.container
+	}
+	return bucketName
+}
+
+// sign returns the URL of the blob which has the service SAS. If blob is empty, the URL of the container is returned.
+func (azure *AzureBlobStorage) sign(container, blob, permissions string, expire time.Duration) string {
+	resource, path := "b", container+"/"+blob
+	if blob == "" {
+		resource, path = "c", container
+	}
+	expiry := time.Now().Add(expire).UTC().Format(azureTimeFormat)
+	stringToSign := strings.Join([]string{
+		permissions,
+		"", // signed start
+		expiry,
+		"/blob/" + azure.account + "/" + path,
+		"", // signed identifier
+		"", // signed IP
+		"", // signed protocol
+		azureAPIVersion,
+		resource,
+		"", // signed snapshot time
+		"", // rscc
+		"", // rscd
+		"", // rsce
+		"", // rscl
+		"", // rsct
+	}, "\n")
+	mac := hmac.New(sha256.New, azure.key)
+	mac.Write([]byte(stringToSign))
+
+	q := url.Values{}
+	q.Set("sv", azureAPIVersion)
+	q.Set("sr", resource)
+	q.Set("sp", permissions)
+	q.Set("se", expiry)
+	q.Set("sig", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return azure.endpoint + "/" + path + "?" + q.Encode()
+}
+
+func (azure *AzureBlobStorage) do(ctx context.Context, method, u string, header map[string]string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return azure.client.Do(req)
+}
+
+func azureError(res *http.Response) error {
+	if res.StatusCode == http.StatusNotFound {
+		return ErrObjectNotExist
+	}
+	return fmt.Errorf("azure: unexpected status %s (%s)", res.Status, res.Header.Get("x-ms-error-code"))
+}
+
+func (azure *AzureBlobStorage) Get(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	return azure.sign(azure.containerName(bucketName), azure.layout.Key(repo, objectID), "r", azure.expire), nil
+}
+
+func (azure *AzureBlobStorage) GetObject(ctx context.Context, bucketName string, repo string, objectID string) (io.ReadCloser, error) {
+	return azure.GetObjectRange(ctx, bucketName, repo, objectID, 0, -1)
+}
+
+func (azure *AzureBlobStorage) GetObjectRange(ctx context.Context, bucketName string, repo string, objectID string, offset, length int64) (io.ReadCloser, error) {
+	// The range of zero bytes can't be represented by x-ms-range
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	header := make(map[string]string)
+	if offset > 0 || length >= 0 {
+		r := fmt.Sprintf("bytes=%d-", offset)
+		if length >= 0 {
+			r += strconv.FormatInt(offset+length-1, 10)
+		}
+		header["x-ms-range"] = r
+	}
+	res, err := azure.do(ctx, http.MethodGet, azure.sign(azure.containerName(bucketName), azure.layout.Key(repo, objectID), "r", azure.expire), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, azureError(res)
+	}
+
+	return res.Body, nil
+}
+
+func (azure *AzureBlobStorage) Put(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	return azure.sign(azure.containerName(bucketName), azure.layout.Key(repo, objectID), "cw", azure.expire), nil
+}
+
+// UploadHeader returns the header which is required by Put Blob.
+func (azure *AzureBlobStorage) UploadHeader(ctx context.Context, bucketName string, repo string, objectID string) map[string]string {
+	return map[string]string{"x-ms-blob-type": "BlockBlob"}
+}
+
+func (azure *AzureBlobStorage) DownloadHeader(ctx context.Context, bucketName string, repo string, objectID string) map[string]string {
+	return nil
+}
+
+// PutObject uploads the object by blocks, and the blocks are committed when the writer is closed.
+func (azure *AzureBlobStorage) PutObject(ctx context.Context, bucketName string, repo string, objectID string) (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	writer := &azureBlobWriter{PipeWriter: w, done: make(chan error, 1)}
+	u := azure.sign(azure.containerName(bucketName), azure.layout.Key(repo, objectID), "cw", azure.expire)
+	go func() {
+		err := azure.uploadBlocks(ctx, u, r)
+		r.CloseWithError(err)
+		writer.done <- err
+	}()
+
+	return writer, nil
+}
+
+type azureEnumerationResults struct {
+	XMLName    xml.Name    `xml:"EnumerationResults"`
+	Blobs      []azureBlob `xml:"Blobs>Blob"`
+	NextMarker string
+}
+
+type azureBlob struct {
+	Name       string
+	Properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		ContentLength int64  `xml:"Content-Length"`
+	}
+}
+
+// List returns objects by List Blobs. The cursor is the marker.
+func (azure *AzureBlobStorage) List(ctx context.Context, bucketName string, repo string, cursor string) ([]*ListedObject, string, error) {
+	u := azure.sign(azure.containerName(bucketName), "", "l", azure.expire) + "&restype=container&comp=list&prefix=" + url.QueryEscape(azure.layout.ListPrefix(repo))
+	if cursor != "" {
+		u += "&marker=" + url.QueryEscape(cursor)
+	}
+	res, err := azure.do(ctx, http.MethodGet, u, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, "", azureError(res)
+	}
+	results := &azureEnumerationResults{}
+	if err := xml.NewDecoder(res.Body).Decode(results); err != nil {
+		return nil, "", err
+	}
+
+	objects := make([]*ListedObject, 0, len(results.Blobs))
+	for _, v := range results.Blobs {
+		objectID, ok := azure.layout.ObjectID(repo, v.Name)
+		if ok == false {
+			continue
+		}
+		lastModified, _ := http.ParseTime(v.Properties.LastModified)
+		objects = append(objects, &ListedObject{ObjectID: objectID, Size: v.Properties.ContentLength, LastModified: lastModified})
+	}
+	return objects, results.NextMarker, nil
+}
+
+type azureBlockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+func (azure *AzureBlobStorage) uploadBlocks(ctx context.Context, u string, r io.Reader) error {
+	blockList := &azureBlockList{}
+	buf := make([]byte, azure.blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// All block ids in the blob must have the same length
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%010d", len(blockList.Latest))))
+		res, err := azure.do(ctx, http.MethodPut, u+"&comp=block&blockid="+url.QueryEscape(id), nil, bytes.NewReader(buf[:n]))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusCreated {
+			return azureError(res)
+		}
+		blockList.Latest = append(blockList.Latest, id)
+
+		if n < len(buf) {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(blockList)
+	if err != nil {
+		return err
+	}
+	res, err := azure.do(ctx, http.MethodPut, u+"&comp=blocklist", nil, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return azureError(res)
+	}
+	return nil
+}
+
+// azureBlobWriter waits for committing the blocks on Close.
+// The uncommitted blocks are discarded by Azure when the upload is aborted.
+type azureBlobWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *azureBlobWriter) Close() error {
+	w.PipeWriter.Close()
+	return <-w.done
+}
+
+func (w *azureBlobWriter) CloseWithError(err error) error {
+	w.PipeWriter.CloseWithError(err)
+	<-w.done
+	return nil
+}
+
+func (azure *AzureBlobStorage) Stat(ctx context.Context, bucketName string, repo string, objectID string) (*ObjectInfo, error) {
+	res, err := azure.do(ctx, http.MethodHead, azure.sign(azure.containerName(bucketName), azure.layout.Key(repo, objectID), "r", azure.expire), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, azureError(res)
+	}
+
+	lastModified, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &ObjectInfo{Size: res.ContentLength, LastModified: lastModified}, nil
+}
+
+func (azure *AzureBlobStorage) Delete(ctx context.Context, bucketName string, repo string, objectID string) error {
+	res, err := azure.do(ctx, http.MethodDelete, azure.sign(azure.containerName(bucketName), azure.layout.Key(repo, objectID), "d", azure.expire), nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted && res.StatusCode != http.StatusNotFound {
+		return azureError(res)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAzureBlob is the minimum stand-in of Blob service which supports block blobs.
+type fakeAzureBlob struct {
+	mu     sync.Mutex
+	blocks map[string][]byte
+	blobs  map[string][]byte
+}
+
+func (f *fakeAzureBlob) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := req.URL.Query()
+	if q.Get("sig") == "" || q.Get("sv") != azureAPIVersion {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodPut && q.Get("comp") == "block":
+		buf, _ := ioutil.ReadAll(req.Body)
+		f.blocks[req.URL.Path+"/"+q.Get("blockid")] = buf
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		blockList := &azureBlockList{}
+		if err := xml.NewDecoder(req.Body).Decode(blockList); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		blob := new(bytes.Buffer)
+		for _, id := range blockList.Latest {
+			blob.Write(f.blocks[req.URL.Path+"/"+id])
+		}
+		f.blobs[req.URL.Path] = blob.Bytes()
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodGet && q.Get("comp") == "list" && q.Get("restype") == "container":
+		// Each page has 2 blobs at most, and the marker is the name of the first blob of the next page
+		names := make([]string, 0)
+		for k := range f.blobs {
+			name := strings.TrimPrefix(k, req.URL.Path+"/")
+			if strings.HasPrefix(name, q.Get("prefix")) && name >= q.Get("marker") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		results := &azureEnumerationResults{}
+		if len(names) > 2 {
+			results.NextMarker = names[2]
+			names = names[:2]
+		}
+		for _, name := range names {
+			blob := azureBlob{Name: name}
+			blob.Properties.ContentLength = int64(len(f.blobs[req.URL.Path+"/"+name]))
+			results.Blobs = append(results.Blobs, blob)
+		}
+		xml.NewEncoder(w).Encode(results)
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		blob, ok := f.blobs[req.URL.Path]
+		if ok == false {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(blob)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func testAzureBlobStorage(t *testing.T, azure *AzureBlobStorage) {
+	objectID := "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+	content := bytes.Repeat([]byte("hello world"), 100)
+
+	w, err := azure.PutObject(context.Background(), "", "f110/test1", objectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := azure.Stat(context.Background(), "", "f110/test1", objectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Errorf("unexpected size: %d", info.Size)
+	}
+
+	r, err := azure.GetObject(context.Background(), "", "f110/test1", objectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(buf, content) == false {
+		t.Error("unexpected content")
+	}
+
+	// The fake returns the whole blob regardless of the range
+	r, err = azure.GetObjectRange(context.Background(), "", "f110/test1", objectID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ = ioutil.ReadAll(r)
+	r.Close()
+	if len(buf) != 0 {
+		t.Errorf("unexpected content of zero bytes: %d bytes", len(buf))
+	}
+
+	_, err = azure.Stat(context.Background(), "", "f110/test1", "0000000000")
+	if err != ErrObjectNotExist {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, id := range []string{oid1, oid2} {
+		w, err := azure.PutObject(context.Background(), "", "f110/test1", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listed := make(map[string]int64)
+	cursor := ""
+	for {
+		objects, next, err := azure.List(context.Background(), "", "f110/test1", cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range objects {
+			listed[o.ObjectID] = o.Size
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(listed) != 3 || listed[objectID] != int64(len(content)) {
+		t.Errorf("unexpected objects: %v", listed)
+	}
+}
+
+func TestAzureBlobStorage(t *testing.T) {
+	fake := &fakeAzureBlob{blocks: make(map[string][]byte), blobs: make(map[string][]byte)}
+	s := httptest.NewServer(fake)
+	defer s.Close()
+
+	// The key is the well-known key of the storage emulator
+	azure, err := NewAzureBlobStorage("devstoreaccount1", "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==", s.URL+"/devstoreaccount1", "lfs", URLExpire, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAzureBlobStorage(t, azure)
+	if len(fake.blocks) != 11 {
+		t.Errorf("the object is not uploaded by blocks: %d", len(fake.blocks))
+	}
+
+	u, err := azure.Put(context.Background(), "", "f110/test1", "4d7a214614ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(u, s.URL+"/devstoreaccount1/lfs/f110/test1/4d7a214614ab?") == false || strings.Contains(u, "sp=cw") == false {
+		t.Errorf("unexpected url: %s", u)
+	}
+}
+
+// TestAzureBlobStorage_Azurite runs against the storage emulator.
+// The container has to be created before running the test.
+func TestAzureBlobStorage_Azurite(t *testing.T) {
+	connectionString := os.Getenv("AZURITE_CONNECTION_STRING")
+	if connectionString == "" {
+		t.Skip("AZURITE_CONNECTION_STRING is not set")
+	}
+	account, key, endpoint, err := parseAzureConnectionString(connectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	azure, err := NewAzureBlobStorage(account, key, endpoint, os.Getenv("AZURITE_CONTAINER"), URLExpire, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAzureBlobStorage(t, azure)
+}
+
+func TestParseAzureConnectionString(t *testing.T) {
+	account, key, endpoint, err := parseAzureConnectionString("DefaultEndpointsProtocol=https;AccountName=lfs;AccountKey=a2V5;EndpointSuffix=core.windows.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account != "lfs" || key != "a2V5" || endpoint != "https://lfs.blob.core.windows.net" {
+		t.Errorf("unexpected result: %s %s %s", account, key, endpoint)
+	}
+
+	_, _, endpoint, err = parseAzureConnectionString("AccountName=devstoreaccount1;AccountKey=a2V5;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint != "http://127.0.0.1:10000/devstoreaccount1" {
+		t.Errorf("unexpected endpoint: %s", endpoint)
+	}
+}
@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+var (
+	errCacheTooLarge = errors.New("object is larger than the cache")
+)
+
+// CachedStorage keeps recently downloaded objects of the backend on the local disk.
+// When the total size of cached objects exceeds the limit, the least recently used objects are evicted.
+// Objects are served through lfs server, and uploads are written to the backend directly.
+// The directory of the cache must not be shared with other repositories.
+// The bucket of the backend is used instead of the bucket which is passed to each method.
+type CachedStorage struct {
+	*objectServer
+	backend *bucketStorage
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // The front is the most recently used
+	size    int64
+	fills   map[string]*cacheFill
+	stats   CacheStats
+}
+
+// CacheStats is the accounting of the cache.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Objects   int
+	Size      int64
+}
+
+type cacheEntry struct {
+	key  string
+	path string
+	size int64
+}
+
+// cacheFill is the download of the object into the cache. Concurrent downloads of the object wait for it.
+type cacheFill struct {
+	done chan struct{}
+	err  error
+}
+
+// cachedConfig is the section of cached driver.
+type cachedConfig struct {
+	// Path is the directory of the cache
+	Path string
+	// CacheSize is the maximum bytes of objects which are kept in Path
+	CacheSize int64 `toml:"cache_size"`
+}
+
+func init() {
+	Register("cached", func(conf *config.Config, repoConf *config.RepositoryConfig, driverConf config.DriverConfig) (Storage, error) {
+		var c cachedConfig
+		if err := driverConf.Decode(&c); err != nil {
+			return nil, err
+		}
+		if c.Path == "" {
+			return nil, errors.New("path is required")
+		}
+		if c.CacheSize <= 0 {
+			return nil, errors.New("cache_size is required")
+		}
+		backend, err := openBackend(conf, repoConf, repoConf.Backend)
+		if err != nil {
+			return nil, err
+		}
+
+		cached, err := newCachedStorage(backend, c.Path, c.CacheSize)
+		if err != nil {
+			return nil, err
+		}
+		cached.objectServer, err = newObjectServer(conf, repoConf, cached)
+		if err != nil {
+			return nil, err
+		}
+		return cached, nil
+	})
+}
+
+func newCachedStorage(backend *bucketStorage, dir string, maxSize int64) (*CachedStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &CachedStorage{
+		backend: backend,
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		fills:   make(map[string]*cacheFill),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load restores the cache from the directory. The modification time of the file is the last access.
+func (c *CachedStorage) load() error {
+	type file struct {
+		entry   *cacheEntry
+		modTime time.Time
+	}
+	files := make([]file, 0)
+	err := filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			// The download was interrupted
+			return os.Remove(p)
+		}
+		rel, err := filepath.Rel(c.dir, p)
+		if err != nil {
+			return err
+		}
+		s := strings.Split(filepath.ToSlash(rel), "/")
+		if len(s) < 4 || validObjectID(info.Name()) == false {
+			return nil
+		}
+		key := strings.Join(s[:len(s)-3], "/") + "/" + info.Name()
+		files = append(files, file{entry: &cacheEntry{key: key, path: p, size: info.Size()}, modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		c.entries[f.entry.key] = c.lru.PushFront(f.entry)
+		c.size += f.entry.size
+	}
+	c.evict()
+	return nil
+}
+
+func (c *CachedStorage) path(repo, objectID string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(repo), objectID[:2], objectID[2:4], objectID)
+}
+
+// Stats returns the accounting of the cache.
+func (c *CachedStorage) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Objects = c.lru.Len()
+	stats.Size = c.size
+	return stats
+}
+
+func (c *CachedStorage) Get(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	return c.url(http.MethodGet, repo, objectID)
+}
+
+// GetObject returns the object in the cache. If the object is not cached, the object is downloaded into the cache first.
+func (c *CachedStorage) GetObject(ctx context.Context, bucketName string, repo string, objectID string) (io.ReadCloser, error) {
+	if validObjectID(objectID) == false {
+		return nil, ErrInvalidObjectID
+	}
+	key := repo + "/" + objectID
+	if f := c.open(key, true); f != nil {
+		return f, nil
+	}
+
+	err := c.fill(repo, objectID)
+	if err == errCacheTooLarge {
+		return c.backend.GetObject(ctx, c.backend.bucket, repo, objectID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f := c.open(key, false); f != nil {
+		return f, nil
+	}
+	// The object has been evicted by other downloads
+	return c.backend.GetObject(ctx, c.backend.bucket, repo, objectID)
+}
+
+// open opens the cached object and marks it as the most recently used.
+// If the object is not cached, open returns nil.
+func (c *CachedStorage) open(key string, hit bool) *os.File {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok == false {
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	f, err := os.Open(entry.path)
+	if err != nil {
+		// The file has been removed by others
+		c.remove(e)
+		return nil
+	}
+	if hit {
+		c.stats.Hits++
+	}
+	c.lru.MoveToFront(e)
+	now := time.Now()
+	os.Chtimes(entry.path, now, now)
+	return f
+}
+
+// fill downloads the object into the cache. The object is downloaded only once even if it is requested concurrently.
+func (c *CachedStorage) fill(repo, objectID string) error {
+	key := repo + "/" + objectID
+	c.mu.Lock()
+	c.stats.Misses++
+	if _, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		return nil
+	}
+	if f, ok := c.fills[key]; ok {
+		c.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &cacheFill{done: make(chan struct{})}
+	c.fills[key] = f
+	c.mu.Unlock()
+
+	f.err = c.download(repo, objectID)
+	c.mu.Lock()
+	delete(c.fills, key)
+	c.mu.Unlock()
+	close(f.done)
+	return f.err
+}
+
+func (c *CachedStorage) download(repo, objectID string) error {
+	// The download is shared by requests, so it is not canceled by any of them
+	ctx := context.Background()
+	info, err := c.backend.Stat(ctx, c.backend.bucket, repo, objectID)
+	if err != nil {
+		return err
+	}
+	if info.Size > c.maxSize {
+		return errCacheTooLarge
+	}
+	r, err := c.backend.GetObject(ctx, c.backend.bucket, repo, objectID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	p := c.path(repo, objectID)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+objectID)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil && n != info.Size {
+		err = fmt.Errorf("storage: unexpected size of %s: %d (expected %d)", objectID, n, info.Size)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[repo+"/"+objectID] = c.lru.PushFront(&cacheEntry{key: repo + "/" + objectID, path: p, size: n})
+	c.size += n
+	c.evict()
+	return nil
+}
+
+// evict removes the least recently used objects until the cache fits the limit. c.mu has to be locked.
+func (c *CachedStorage) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *CachedStorage) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	os.Remove(entry.path)
+}
+
+func (c *CachedStorage) Put(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	return c.url(http.MethodPut, repo, objectID)
+}
+
+func (c *CachedStorage) PutObject(ctx context.Context, bucketName string, repo string, objectID string) (io.WriteCloser, error) {
+	return c.backend.PutObject(ctx, c.backend.bucket, repo, objectID)
+}
+
+// Stat returns the cached object if it exists. Otherwise, the object in the backend is returned.
+func (c *CachedStorage) Stat(ctx context.Context, bucketName string, repo string, objectID string) (*ObjectInfo, error) {
+	if validObjectID(objectID) == false {
+		return nil, ErrInvalidObjectID
+	}
+	c.mu.Lock()
+	e, ok := c.entries[repo+"/"+objectID]
+	c.mu.Unlock()
+	if ok {
+		if info, err := os.Stat(e.Value.(*cacheEntry).path); err == nil {
+			return &ObjectInfo{Size: info.Size(), LastModified: info.ModTime()}, nil
+		}
+	}
+	return c.backend.Stat(ctx, c.backend.bucket, repo, objectID)
+}
+
+// List returns objects in the backend.
+func (c *CachedStorage) List(ctx context.Context, bucketName string, repo string, cursor string) ([]*ListedObject, string, error) {
+	return c.backend.List(ctx, c.backend.bucket, repo, cursor)
+}
+
+// Delete removes the object from the cache and the backend.
+func (c *CachedStorage) Delete(ctx context.Context, bucketName string, repo string, objectID string) error {
+	c.mu.Lock()
+	if e, ok := c.entries[repo+"/"+objectID]; ok {
+		c.remove(e)
+	}
+	c.mu.Unlock()
+	return c.backend.Delete(ctx, c.backend.bucket, repo, objectID)
+}
+
+func (c *CachedStorage) TransferAdapters() []string {
+	return []string{TransferBasic}
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+// countingStorage counts downloads and makes them slow enough to overlap.
+type countingStorage struct {
+	Storage
+	downloads int32
+}
+
+func (s *countingStorage) GetObject(ctx context.Context, bucketName, repo, objectID string) (io.ReadCloser, error) {
+	atomic.AddInt32(&s.downloads, 1)
+	time.Sleep(50 * time.Millisecond)
+	return s.Storage.GetObject(ctx, bucketName, repo, objectID)
+}
+
+func TestCachedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cached_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local, err := NewLocalStorage(filepath.Join(dir, "backend"), "", []byte("test"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &countingStorage{Storage: local}
+	ctx := context.Background()
+	for _, objectID := range []string{oid1, oid2, oid3, oid4} {
+		w, err := backend.PutObject(ctx, "", "f110/test1", objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, strings.Repeat(objectID[:1], 10))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := newCachedStorage(&bucketStorage{Storage: backend}, filepath.Join(dir, "cache"), 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(c *CachedStorage, objectID string) string {
+		r, err := c.GetObject(ctx, "", "f110/test1", objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		buf, _ := ioutil.ReadAll(r)
+		return string(buf)
+	}
+
+	t.Run("single flight", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if buf := get(c, oid1); buf != strings.Repeat("1", 10) {
+					t.Errorf("unexpected content: %s", buf)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := atomic.LoadInt32(&backend.downloads); n != 1 {
+			t.Errorf("unexpected number of downloads: %d", n)
+		}
+
+		get(c, oid1)
+		stats := c.Stats()
+		if stats.Misses+stats.Hits != 11 || stats.Hits < 1 || stats.Objects != 1 || stats.Size != 10 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		get(c, oid2)
+		get(c, oid1)
+		get(c, oid3)
+		// 22222 is the least recently used
+		stats := c.Stats()
+		if stats.Objects != 2 || stats.Size != 20 || stats.Evictions != 1 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+		downloads := atomic.LoadInt32(&backend.downloads)
+		get(c, oid1)
+		if atomic.LoadInt32(&backend.downloads) != downloads {
+			t.Error("recently used object is evicted")
+		}
+		get(c, oid2)
+		if atomic.LoadInt32(&backend.downloads) != downloads+1 {
+			t.Error("least recently used object is not evicted")
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		reloaded, err := newCachedStorage(&bucketStorage{Storage: backend}, filepath.Join(dir, "cache"), 25)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats := reloaded.Stats()
+		if stats.Objects != 2 || stats.Size != 20 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+		downloads := atomic.LoadInt32(&backend.downloads)
+		if buf := get(reloaded, oid2); buf != strings.Repeat("2", 10) {
+			t.Errorf("unexpected content: %s", buf)
+		}
+		if atomic.LoadInt32(&backend.downloads) != downloads {
+			t.Error("cached object is downloaded again")
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		small, err := newCachedStorage(&bucketStorage{Storage: backend}, filepath.Join(dir, "small"), 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf := get(small, oid4); buf != strings.Repeat("4", 10) {
+			t.Errorf("unexpected content: %s", buf)
+		}
+		if stats := small.Stats(); stats.Objects != 0 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+	})
+}
+
+func TestCachedStorage_ServeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cached_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mux := http.NewServeMux()
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	st, err := Open(&config.Config{URL: s.URL}, &config.RepositoryConfig{
+		Owner:      "f110",
+		Repo:       "test1",
+		Storage:    "cached",
+		SigningKey: "test",
+		Drivers:    map[string]config.DriverConfig{"cached": {"path": filepath.Join(dir, "cache"), "cache_size": 1024}},
+		Backend:    &config.RepositoryConfig{Storage: "local", Drivers: map[string]config.DriverConfig{"local": {"path": filepath.Join(dir, "backend")}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle(ObjectPathPrefix, st.(http.Handler))
+
+	u, err := st.Put(context.Background(), "", "f110/test1", oid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPut, u, strings.NewReader("hello cache"))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", res.StatusCode)
+	}
+
+	for i := 0; i < 2; i++ {
+		u, err = st.Get(context.Background(), "", "f110/test1", oid1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err = http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "hello cache" {
+			t.Errorf("unexpected response: %s", body)
+		}
+	}
+	if stats := st.(*CachedStorage).Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
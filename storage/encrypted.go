@@ -0,0 +1,457 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/database"
+)
+
+const (
+	encryptedMagic      = "LFE1"
+	encryptedHeaderSize = 12 // magic and the prefix of nonce
+	encryptedChunkSize  = 64 * 1024
+	encryptedOverhead   = 16 // the tag of AES-GCM
+)
+
+var (
+	ErrCorruptedObject = errors.New("object is corrupted")
+)
+
+// EncryptedStorage encrypts objects by the data key of each object before storing them in the backend.
+// Data keys are wrapped by the master key and saved in the database, so the master key can be rotated
+// by rewrapping data keys without re-encrypting objects.
+//
+// The object is encrypted by AES-GCM chunk by chunk so that it can be streamed.
+// The last chunk is marked by the additional data to detect the truncated object.
+// Objects are served through lfs server because the client can't decrypt them.
+// The bucket of the backend is used instead of the bucket which is passed to each method.
+type EncryptedStorage struct {
+	*objectServer
+	backend *bucketStorage
+	keys    *masterKeys
+}
+
+// encryptedConfig is the section of encrypted driver.
+type encryptedConfig struct {
+	// MasterKeyFile is the file of master keys which wrap data keys
+	MasterKeyFile string `toml:"master_key_file"`
+}
+
+func init() {
+	Register("encrypted", func(conf *config.Config, repoConf *config.RepositoryConfig, driverConf config.DriverConfig) (Storage, error) {
+		var c encryptedConfig
+		if err := driverConf.Decode(&c); err != nil {
+			return nil, err
+		}
+		if c.MasterKeyFile == "" {
+			return nil, errors.New("master_key_file is required")
+		}
+		keys, err := readMasterKeys(c.MasterKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		backend, err := openBackend(conf, repoConf, repoConf.Backend)
+		if err != nil {
+			return nil, err
+		}
+
+		e := &EncryptedStorage{backend: backend, keys: keys}
+		e.objectServer, err = newObjectServer(conf, repoConf, e)
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	})
+}
+
+// masterKeys are the keys which wrap data keys.
+type masterKeys struct {
+	current string
+	aead    map[string]cipher.AEAD
+	// file is the absolute path of the key file. Data keys are saved in the namespace of the file.
+	file string
+}
+
+// readMasterKeys reads the key file. Each line of the file is "<key id>:<base64 encoded 256 bit key>".
+// The key in the first line wraps new data keys, and the others are used only for unwrapping.
+func readMasterKeys(path string) (*masterKeys, error) {
+	file, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	keys := &masterKeys{aead: make(map[string]cipher.AEAD), file: file}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s := strings.SplitN(line, ":", 2)
+		if len(s) != 2 || s[0] == "" {
+			return nil, fmt.Errorf("invalid master key: %s", s[0])
+		}
+		key, err := base64.StdEncoding.DecodeString(s[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("master key %s has to be the base64 encoded 256 bit key", s[0])
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		if keys.current == "" {
+			keys.current = s[0]
+		}
+		keys.aead[s[0]] = aead
+	}
+	if keys.current == "" {
+		return nil, errors.New("no master key is found")
+	}
+	return keys, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type wrappedKey struct {
+	KeyID string
+	Nonce []byte
+	Key   []byte
+}
+
+func (m *masterKeys) wrap(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead[m.current].NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&wrappedKey{KeyID: m.current, Nonce: nonce, Key: m.aead[m.current].Seal(nil, nonce, dataKey, []byte(m.current))})
+}
+
+func (m *masterKeys) unwrap(wrapped []byte) ([]byte, error) {
+	k := &wrappedKey{}
+	if err := json.Unmarshal(wrapped, k); err != nil {
+		return nil, err
+	}
+	aead, ok := m.aead[k.KeyID]
+	if ok == false {
+		return nil, fmt.Errorf("master key %s is not found", k.KeyID)
+	}
+	return aead.Open(nil, k.Nonce, k.Key, []byte(k.KeyID))
+}
+
+// rewrap wraps the data key by the current master key. If the data key is already wrapped by the current key
+// or the key file doesn't have the master key of the data key, rewrap returns nil.
+func (m *masterKeys) rewrap(wrapped []byte) ([]byte, error) {
+	k := &wrappedKey{}
+	if err := json.Unmarshal(wrapped, k); err != nil {
+		return nil, err
+	}
+	if _, ok := m.aead[k.KeyID]; ok == false || k.KeyID == m.current {
+		return nil, nil
+	}
+	dataKey, err := m.unwrap(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return m.wrap(dataKey)
+}
+
+// MasterKeyFile returns the master key file in the section of encrypted driver of the repository.
+// If the repository doesn't have the section, MasterKeyFile returns the empty string.
+func MasterKeyFile(repoConf *config.RepositoryConfig) (string, error) {
+	var c encryptedConfig
+	err := repoConf.Drivers["encrypted"].Decode(&c)
+	return c.MasterKeyFile, err
+}
+
+// RewrapDataKeys wraps all data keys by the current master key in masterKeyFile, and returns the number of rewrapped keys.
+// After rewrapping, the old master keys can be removed from the key file.
+func RewrapDataKeys(masterKeyFile string) (int, error) {
+	keys, err := readMasterKeys(masterKeyFile)
+	if err != nil {
+		return 0, err
+	}
+	return database.UpdateDataKeys(keys.file, func(name string, wrapped []byte) ([]byte, error) {
+		return keys.rewrap(wrapped)
+	})
+}
+
+// dataKey returns the cipher of the data key of the object.
+// If create is true and the object doesn't have the data key, the data key is generated.
+func (e *EncryptedStorage) dataKey(objectID string, create bool) (cipher.AEAD, error) {
+	// Objects which have the same object id have the same content, so they share the data key.
+	// The key is saved in the namespace of the key file so that rewrapping doesn't touch the keys of other key files.
+	name := e.backend.bucket + "/" + objectID
+	wrapped, err := database.ReadDataKey(e.keys.file, name)
+	if err == database.ErrNotFound && create {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		w, err := e.keys.wrap(key)
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err = database.CreateDataKey(e.keys.file, name, w)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	key, err := e.keys.unwrap(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(key)
+}
+
+func (e *EncryptedStorage) Get(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	return e.url(http.MethodGet, repo, objectID)
+}
+
+func (e *EncryptedStorage) GetObject(ctx context.Context, bucketName string, repo string, objectID string) (io.ReadCloser, error) {
+	r, err := e.backend.GetObject(ctx, e.backend.bucket, repo, objectID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := e.dataKey(objectID, false)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("storage: failed to read the data key of %s: %v", objectID, err)
+	}
+
+	br := bufio.NewReader(r)
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil || bytes.HasPrefix(header, []byte(encryptedMagic)) == false {
+		r.Close()
+		return nil, ErrCorruptedObject
+	}
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[len(encryptedMagic):])
+
+	return &decryptReader{
+		r:     br,
+		c:     r,
+		aead:  aead,
+		nonce: nonce,
+		buf:   make([]byte, encryptedChunkSize+encryptedOverhead),
+	}, nil
+}
+
+func (e *EncryptedStorage) Put(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	return e.url(http.MethodPut, repo, objectID)
+}
+
+func (e *EncryptedStorage) PutObject(ctx context.Context, bucketName string, repo string, objectID string) (io.WriteCloser, error) {
+	aead, err := e.dataKey(objectID, true)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce[:len(nonce)-4]); err != nil {
+		return nil, err
+	}
+
+	w, err := e.backend.PutObject(ctx, e.backend.bucket, repo, objectID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(encryptedMagic), nonce[:len(nonce)-4]...)); err != nil {
+		AbortWriter(w, err)
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:     w,
+		aead:  aead,
+		nonce: nonce,
+		buf:   make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+// Stat returns the size of the plaintext.
+func (e *EncryptedStorage) Stat(ctx context.Context, bucketName string, repo string, objectID string) (*ObjectInfo, error) {
+	info, err := e.backend.Stat(ctx, e.backend.bucket, repo, objectID)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := plaintextSize(info.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Size: size, LastModified: info.LastModified}, nil
+}
+
+func (e *EncryptedStorage) Delete(ctx context.Context, bucketName string, repo string, objectID string) error {
+	return e.backend.Delete(ctx, e.backend.bucket, repo, objectID)
+}
+
+// List returns objects in the backend with the size of the plaintext. Corrupted objects are not listed.
+func (e *EncryptedStorage) List(ctx context.Context, bucketName string, repo string, cursor string) ([]*ListedObject, string, error) {
+	objects, next, err := e.backend.List(ctx, e.backend.bucket, repo, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	res := make([]*ListedObject, 0, len(objects))
+	for _, o := range objects {
+		size, err := plaintextSize(o.Size)
+		if err != nil {
+			continue
+		}
+		res = append(res, &ListedObject{ObjectID: o.ObjectID, Size: size, LastModified: o.LastModified})
+	}
+	return res, next, nil
+}
+
+// plaintextSize returns the size of the plaintext of the encrypted object.
+func plaintextSize(size int64) (int64, error) {
+	n := size - encryptedHeaderSize
+	if n < encryptedOverhead {
+		return 0, ErrCorruptedObject
+	}
+	chunks := (n + encryptedChunkSize + encryptedOverhead - 1) / (encryptedChunkSize + encryptedOverhead)
+	return n - chunks*encryptedOverhead, nil
+}
+
+func (e *EncryptedStorage) TransferAdapters() []string {
+	return []string{TransferBasic}
+}
+
+// encryptWriter encrypts the object chunk by chunk. The last chunk is written when the writer is closed.
+type encryptWriter struct {
+	w       io.WriteCloser
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// The full chunk is sealed only when more data comes, because it might be the last chunk
+		if len(ew.buf) == encryptedChunkSize {
+			if err := ew.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (ew *encryptWriter) seal(last bool) error {
+	binary.BigEndian.PutUint32(ew.nonce[len(ew.nonce)-4:], ew.counter)
+	ew.counter++
+	ad := []byte{0}
+	if last {
+		ad[0] = 1
+	}
+	_, err := ew.w.Write(ew.aead.Seal(nil, ew.nonce, ew.buf, ad))
+	ew.buf = ew.buf[:0]
+	return err
+}
+
+func (ew *encryptWriter) Close() error {
+	if err := ew.seal(true); err != nil {
+		AbortWriter(ew.w, err)
+		return err
+	}
+	return ew.w.Close()
+}
+
+func (ew *encryptWriter) CloseWithError(err error) error {
+	return AbortWriter(ew.w, err)
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	c       io.Closer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	plain   []byte
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.buf)
+	last := false
+	switch err {
+	case nil:
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		// The last chunk is missing
+		return ErrCorruptedObject
+	default:
+		return err
+	}
+
+	binary.BigEndian.PutUint32(d.nonce[len(d.nonce)-4:], d.counter)
+	d.counter++
+	ad := []byte{0}
+	if last {
+		ad[0] = 1
+	}
+	plain, err := d.aead.Open(d.buf[:0], d.nonce, d.buf[:n], ad)
+	if err != nil {
+		return ErrCorruptedObject
+	}
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.c.Close()
+}
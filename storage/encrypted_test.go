@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/database"
+)
+
+func writeMasterKeys(t *testing.T, path string, ids ...string) {
+	buf := new(bytes.Buffer)
+	for _, id := range ids {
+		key := make([]byte, 32)
+		rand.Read(key)
+		buf.WriteString(id + ":" + base64.StdEncoding.EncodeToString(key) + "\n")
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypted_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	database.Conn = db
+
+	mux := http.NewServeMux()
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	keyFile := filepath.Join(dir, "master.key")
+	writeMasterKeys(t, keyFile, "key1")
+	repoConf := &config.RepositoryConfig{
+		Owner:      "f110",
+		Repo:       "test1",
+		Storage:    "encrypted",
+		SigningKey: "test",
+		Drivers:    map[string]config.DriverConfig{"encrypted": {"master_key_file": keyFile}},
+		Backend:    &config.RepositoryConfig{Storage: "local", Drivers: map[string]config.DriverConfig{"local": {"path": filepath.Join(dir, "objects")}}},
+	}
+	st, err := Open(&config.Config{URL: s.URL}, repoConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle(ObjectPathPrefix, st.(http.Handler))
+
+	put := func(objectID string, content []byte) {
+		w, err := st.PutObject(context.Background(), "", "f110/test1", objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(objectID string) ([]byte, error) {
+		r, err := st.GetObject(context.Background(), "", "f110/test1", objectID)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		for i, size := range []int{0, 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize - 7} {
+			objectID := strings.Repeat("0", 63) + string('a'+rune(i))
+			content := make([]byte, size)
+			rand.Read(content)
+			put(objectID, content)
+
+			info, err := st.Stat(context.Background(), "", "f110/test1", objectID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size != int64(size) {
+				t.Errorf("unexpected size: %d (expected %d)", info.Size, size)
+			}
+			buf, err := get(objectID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(buf, content) == false {
+				t.Errorf("unexpected content of %d bytes", size)
+			}
+		}
+
+		stored, err := ioutil.ReadFile(filepath.Join(dir, "objects", "f110", "test1", "00", "00", strings.Repeat("0", 63)+"b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasPrefix(stored, []byte(encryptedMagic)) == false {
+			t.Error("object is not encrypted")
+		}
+	})
+
+	t.Run("signed url", func(t *testing.T) {
+		u, err := st.Put(context.Background(), "", "f110/test1", oid1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodPut, u, bytes.NewReader([]byte("hello encrypted world")))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+
+		u, err = st.Get(context.Background(), "", "f110/test1", oid1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err = http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "hello encrypted world" || res.ContentLength != int64(len(body)) {
+			t.Errorf("unexpected response: %d %s", res.ContentLength, body)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		content := make([]byte, 2*encryptedChunkSize+1)
+		put(oid2, content)
+		p := filepath.Join(dir, "objects", "f110", "test1", "22", "22", oid2)
+		stored, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Drop the last chunk at the boundary of chunks
+		if err := ioutil.WriteFile(p, stored[:encryptedHeaderSize+2*(encryptedChunkSize+encryptedOverhead)], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := get(oid2); err != ErrCorruptedObject {
+			t.Errorf("truncated object is not detected: %v", err)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		old, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeMasterKeys(t, keyFile, "key2")
+		rotated, _ := ioutil.ReadFile(keyFile)
+		if err := ioutil.WriteFile(keyFile, append(rotated, old...), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// The data keys of other key files are not rewrapped
+		otherKeyFile := filepath.Join(dir, "other.key")
+		writeMasterKeys(t, otherKeyFile, "other")
+		n, err := RewrapDataKeys(otherKeyFile)
+		if err != nil || n != 0 {
+			t.Errorf("data keys of other key file are rewrapped: %d %v", n, err)
+		}
+
+		n, err = RewrapDataKeys(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 7 {
+			t.Errorf("unexpected number of rewrapped keys: %d", n)
+		}
+
+		// The old key is no longer needed
+		if err := ioutil.WriteFile(keyFile, rotated, 0600); err != nil {
+			t.Fatal(err)
+		}
+		st, err = Open(&config.Config{URL: s.URL}, repoConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := get(oid1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello encrypted world" {
+			t.Errorf("unexpected content: %s", buf)
+		}
+	})
+}
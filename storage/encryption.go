@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+const (
+	EncryptionSSES3  = "sse-s3"
+	EncryptionSSEKMS = "sse-kms"
+	EncryptionSSEC   = "sse-c"
+	EncryptionCMEK   = "cmek"
+)
+
+// Encryption is the server-side encryption of objects.
+type Encryption struct {
+	Mode string
+	// KMSKeyID is the key id of SSE-KMS or the resource name of the key of CMEK
+	KMSKeyID string
+	// CustomerKey is the key of SSE-C
+	CustomerKey []byte
+}
+
+// encryptionConfig is the configuration of the server-side encryption which is embedded in the section of the driver.
+type encryptionConfig struct {
+	// Encryption is "sse-s3", "sse-kms" and "sse-c" for S3, and "cmek" for GCS
+	Encryption string
+	// KMSKeyID is the key id of SSE-KMS or the resource name of the key of CMEK
+	KMSKeyID string `toml:"kms_key_id"`
+	// CustomerKey is the base64 encoded 256 bit key of SSE-C
+	CustomerKey string `toml:"customer_key"`
+}
+
+// newEncryption returns the encryption of the configuration.
+// If the encryption is not configured, newEncryption returns nil.
+func newEncryption(conf encryptionConfig, modes ...string) (*Encryption, error) {
+	if conf.Encryption == "" {
+		return nil, nil
+	}
+	supported := false
+	for _, m := range modes {
+		if m == conf.Encryption {
+			supported = true
+		}
+	}
+	if supported == false {
+		return nil, fmt.Errorf("unsupported encryption: %s (supported: %v)", conf.Encryption, modes)
+	}
+
+	e := &Encryption{Mode: conf.Encryption, KMSKeyID: conf.KMSKeyID}
+	switch e.Mode {
+	case EncryptionCMEK:
+		if e.KMSKeyID == "" {
+			return nil, errors.New("kms_key_id is required by cmek")
+		}
+	case EncryptionSSEC:
+		key, err := base64.StdEncoding.DecodeString(conf.CustomerKey)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("customer_key has to be the base64 encoded 256 bit key")
+		}
+		e.CustomerKey = key
+	}
+	return e, nil
+}
+
+// customerKeyMD5 returns the base64 encoded MD5 digest of the customer key.
+func (e *Encryption) customerKeyMD5() string {
+	sum := md5.Sum(e.CustomerKey)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
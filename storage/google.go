@@ -2,67 +2,354 @@ package storage
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"sort"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/f110/git-lfs-cloud/config"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
+const (
+	gcsListPageSize = 1000
+	// gcsMaxComposeSources is the maximum number of source objects of a compose request
+	gcsMaxComposeSources = 32
+)
+
 type GoogleCloudStorage struct {
 	client     *storage.Client
 	privateKey []byte
 	accessID   string
+	expire     time.Duration
+	partSize   int64
+	layout     *KeyLayout
+	encryption *Encryption
+}
+
+// googleConfig is the section of google driver.
+type googleConfig struct {
+	CredentialFile string `toml:"credential_file"`
+	AccessID       string `toml:"access_id"`
+	// PartSize is the size of each part of multipart upload
+	PartSize int64 `toml:"part_size"`
+	encryptionConfig
+}
+
+func init() {
+	Register("google", func(_ *config.Config, repoConf *config.RepositoryConfig, driverConf config.DriverConfig) (Storage, error) {
+		var c googleConfig
+		if err := driverConf.Decode(&c); err != nil {
+			return nil, err
+		}
+		gcs, err := NewCloudStorage(c.AccessID, c.CredentialFile, urlExpire(repoConf), c.PartSize)
+		if err != nil {
+			return nil, err
+		}
+		gcs.layout, err = newKeyLayout(repoConf.KeyLayout, gcs.layout)
+		if err != nil {
+			return nil, err
+		}
+		gcs.encryption, err = newEncryption(c.encryptionConfig, EncryptionCMEK)
+		return gcs, err
+	})
 }
 
-func NewCloudStorage(accessID, credentialFile string) *GoogleCloudStorage {
+func NewCloudStorage(accessID, credentialFile string, expire time.Duration, partSize int64) (*GoogleCloudStorage, error) {
 	client, err := storage.NewClient(context.Background(), option.WithCredentialsFile(credentialFile))
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	creds, err := ioutil.ReadFile(credentialFile)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	jwtConfig, err := google.JWTConfigFromJSON(creds, "")
 	if err != nil {
-		return nil
+		return nil, err
+	}
+
+	if partSize <= 0 {
+		partSize = DefaultMultipartPartSize
 	}
 
-	return &GoogleCloudStorage{client: client, privateKey: jwtConfig.PrivateKey, accessID: jwtConfig.Email}
+	return &GoogleCloudStorage{
+		client:     client,
+		privateKey: jwtConfig.PrivateKey,
+		accessID:   jwtConfig.Email,
+		expire:     expire,
+		partSize:   partSize,
+		layout:     &KeyLayout{},
+	}, nil
 }
 
-func (gcs *GoogleCloudStorage) Get(bucketName, repo, objectID string) (string, error) {
-	return storage.SignedURL(bucketName, repo+"/"+objectID, &storage.SignedURLOptions{
+func (gcs *GoogleCloudStorage) Get(ctx context.Context, bucketName, repo, objectID string) (string, error) {
+	return storage.SignedURL(bucketName, gcs.layout.Key(repo, objectID), &storage.SignedURLOptions{
 		Method:         http.MethodGet,
 		PrivateKey:     gcs.privateKey,
 		GoogleAccessID: gcs.accessID,
-		Expires:        time.Now().Add(URLExpire),
+		Expires:        time.Now().Add(gcs.expire),
 		ContentType:    "application/octet-stream",
 	})
 }
 
 func (gcs *GoogleCloudStorage) GetObject(ctx context.Context, bucketName, repo, objectID string) (io.ReadCloser, error) {
-	return gcs.client.Bucket(bucketName).Object(repo + "/" + objectID).NewReader(ctx)
+	return gcs.client.Bucket(bucketName).Object(gcs.layout.Key(repo, objectID)).NewReader(ctx)
 }
 
-func (gcs *GoogleCloudStorage) Put(bucketName, repo, objectID string) (string, error) {
-	_, err := gcs.client.Bucket(bucketName).Object(repo + "/" + objectID).Attrs(context.Background())
+func (gcs *GoogleCloudStorage) GetObjectRange(ctx context.Context, bucketName, repo, objectID string, offset, length int64) (io.ReadCloser, error) {
+	return gcs.client.Bucket(bucketName).Object(gcs.layout.Key(repo, objectID)).NewRangeReader(ctx, offset, length)
+}
+
+func (gcs *GoogleCloudStorage) Put(ctx context.Context, bucketName, repo, objectID string) (string, error) {
+	_, err := gcs.client.Bucket(bucketName).Object(gcs.layout.Key(repo, objectID)).Attrs(ctx)
 	if err == storage.ErrObjectNotExist {
-		return storage.SignedURL(bucketName, repo+"/"+objectID, &storage.SignedURLOptions{
+		return storage.SignedURL(bucketName, gcs.layout.Key(repo, objectID), &storage.SignedURLOptions{
 			Method:         http.MethodPut,
 			PrivateKey:     gcs.privateKey,
 			GoogleAccessID: gcs.accessID,
-			Expires:        time.Now().Add(URLExpire),
+			Expires:        time.Now().Add(gcs.expire),
 			ContentType:    "application/octet-stream",
+			Headers:        gcs.signedHeaders(),
 		})
 	}
 	return "", nil
 }
 
 func (gcs *GoogleCloudStorage) PutObject(ctx context.Context, bucketName, repo, objectID string) (io.WriteCloser, error) {
-	return gcs.client.Bucket(bucketName).Object(repo + "/" + objectID).NewWriter(ctx), nil
+	w := gcs.client.Bucket(bucketName).Object(gcs.layout.Key(repo, objectID)).NewWriter(ctx)
+	if gcs.encryption != nil {
+		w.KMSKeyName = gcs.encryption.KMSKeyID
+	}
+	return w, nil
+}
+
+// List returns objects by the object iterator. The cursor is the page token.
+func (gcs *GoogleCloudStorage) List(ctx context.Context, bucketName, repo, cursor string) ([]*ListedObject, string, error) {
+	it := gcs.client.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: gcs.layout.ListPrefix(repo)})
+	attrs := make([]*storage.ObjectAttrs, 0, gcsListPageSize)
+	next, err := iterator.NewPager(it, gcsListPageSize, cursor).NextPage(&attrs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	objects := make([]*ListedObject, 0, len(attrs))
+	for _, v := range attrs {
+		objectID, ok := gcs.layout.ObjectID(repo, v.Name)
+		if ok == false {
+			continue
+		}
+		objects = append(objects, &ListedObject{ObjectID: objectID, Size: v.Size, LastModified: v.Updated})
+	}
+	return objects, next, nil
+}
+
+// UploadHeader returns the header of CMEK which is signed in the URL.
+func (gcs *GoogleCloudStorage) UploadHeader(ctx context.Context, bucketName, repo, objectID string) map[string]string {
+	if gcs.encryption == nil {
+		return nil
+	}
+	return map[string]string{"x-goog-encryption-kms-key-name": gcs.encryption.KMSKeyID}
+}
+
+func (gcs *GoogleCloudStorage) DownloadHeader(ctx context.Context, bucketName, repo, objectID string) map[string]string {
+	return nil
+}
+
+// signedHeaders returns the extension headers which are signed in the URL for the upload.
+func (gcs *GoogleCloudStorage) signedHeaders() []string {
+	if gcs.encryption == nil {
+		return nil
+	}
+	return []string{"x-goog-encryption-kms-key-name:" + gcs.encryption.KMSKeyID}
+}
+
+func (gcs *GoogleCloudStorage) Stat(ctx context.Context, bucketName, repo, objectID string) (*ObjectInfo, error) {
+	attrs, err := gcs.client.Bucket(bucketName).Object(gcs.layout.Key(repo, objectID)).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{Size: attrs.Size, LastModified: attrs.Updated}, nil
+}
+
+func (gcs *GoogleCloudStorage) Delete(ctx context.Context, bucketName, repo, objectID string) error {
+	err := gcs.client.Bucket(bucketName).Object(gcs.layout.Key(repo, objectID)).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return err
+}
+
+func (gcs *GoogleCloudStorage) TransferAdapters() []string {
+	return []string{TransferMultipart, TransferBasic}
+}
+
+// CreateMultipartUpload returns the signed URL of each part. Each part is uploaded as a separate object,
+// so the parts can be uploaded in any order, and they are combined by compose on completion.
+// The upload id is the random name of the directory of the parts, so the client can't point other objects by it.
+func (gcs *GoogleCloudStorage) CreateMultipartUpload(ctx context.Context, bucketName, repo, objectID string, size int64) (*MultipartUpload, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	uploadID := hex.EncodeToString(buf)
+
+	parts := splitParts(size, gcs.partSize)
+	for i := range parts {
+		u, err := storage.SignedURL(bucketName, gcs.partName(repo, objectID, uploadID, parts[i].Number), &storage.SignedURLOptions{
+			Method:         http.MethodPut,
+			PrivateKey:     gcs.privateKey,
+			GoogleAccessID: gcs.accessID,
+			Expires:        time.Now().Add(gcs.expire),
+			ContentType:    "application/octet-stream",
+			Headers:        gcs.signedHeaders(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		header := map[string]string{"Content-Type": "application/octet-stream"}
+		for k, v := range gcs.UploadHeader(ctx, bucketName, repo, objectID) {
+			header[k] = v
+		}
+		parts[i].Href = u
+		parts[i].Method = http.MethodPut
+		parts[i].Header = header
+	}
+
+	return &MultipartUpload{UploadID: uploadID, Parts: parts}, nil
+}
+
+// partPrefix returns the prefix of the objects of the parts and the intermediate objects of compose.
+func (gcs *GoogleCloudStorage) partPrefix(repo, objectID, uploadID string) string {
+	return gcs.layout.Key(repo, objectID) + ".parts/" + uploadID + "/"
+}
+
+func (gcs *GoogleCloudStorage) partName(repo, objectID, uploadID string, number int) string {
+	return fmt.Sprintf("%spart-%06d", gcs.partPrefix(repo, objectID, uploadID), number)
+}
+
+// CompleteMultipartUpload combines the uploaded parts into the object.
+// GCS composes at most 32 objects at once, so many parts are composed into intermediate objects first.
+func (gcs *GoogleCloudStorage) CompleteMultipartUpload(ctx context.Context, bucketName, repo, objectID, uploadID string, size int64) error {
+	if validUploadID(uploadID) == false {
+		return ErrInvalidUploadID
+	}
+	bucket := gcs.client.Bucket(bucketName)
+	prefix := gcs.partPrefix(repo, objectID, uploadID)
+	uploaded, err := gcs.listParts(ctx, bucket, prefix+"part-")
+	if err != nil {
+		return err
+	}
+	if len(uploaded) == 0 {
+		return ErrObjectNotExist
+	}
+	expected := splitParts(size, gcs.partSize)
+	names := make([]string, 0, len(uploaded))
+	for i, attrs := range uploaded {
+		if len(uploaded) != len(expected) || attrs.Name != gcs.partName(repo, objectID, uploadID, expected[i].Number) || attrs.Size != expected[i].Size {
+			if err := gcs.deleteParts(ctx, bucket, prefix); err != nil {
+				log.Print(err)
+			}
+			return ErrPartsMismatch
+		}
+		names = append(names, attrs.Name)
+	}
+
+	for round := 0; len(names) > gcsMaxComposeSources; round++ {
+		composed := make([]string, 0, len(names)/gcsMaxComposeSources+1)
+		for i := 0; i < len(names); i += gcsMaxComposeSources {
+			end := i + gcsMaxComposeSources
+			if end > len(names) {
+				end = len(names)
+			}
+			name := fmt.Sprintf("%scompose-%d-%06d", prefix, round, len(composed))
+			if err := gcs.compose(ctx, bucket, name, names[i:end]); err != nil {
+				return err
+			}
+			composed = append(composed, name)
+		}
+		names = composed
+	}
+	if err := gcs.compose(ctx, bucket, gcs.layout.Key(repo, objectID), names); err != nil {
+		return err
+	}
+
+	if err := gcs.deleteParts(ctx, bucket, prefix); err != nil {
+		log.Print(err)
+	}
+	return nil
+}
+
+func (gcs *GoogleCloudStorage) compose(ctx context.Context, bucket *storage.BucketHandle, dst string, srcs []string) error {
+	objects := make([]*storage.ObjectHandle, 0, len(srcs))
+	for _, v := range srcs {
+		objects = append(objects, bucket.Object(v))
+	}
+	c := bucket.Object(dst).ComposerFrom(objects...)
+	c.ContentType = "application/octet-stream"
+	if gcs.encryption != nil {
+		c.KMSKeyName = gcs.encryption.KMSKeyID
+	}
+	_, err := c.Run(ctx)
+	return err
+}
+
+// listParts returns the objects which start with prefix in the order of names.
+func (gcs *GoogleCloudStorage) listParts(ctx context.Context, bucket *storage.BucketHandle, prefix string) ([]*storage.ObjectAttrs, error) {
+	objects := make([]*storage.ObjectAttrs, 0)
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, attrs)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (gcs *GoogleCloudStorage) deleteParts(ctx context.Context, bucket *storage.BucketHandle, prefix string) error {
+	objects, err := gcs.listParts(ctx, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	for _, v := range objects {
+		if err := bucket.Object(v.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+	return nil
+}
+
+// AbortMultipartUpload deletes the uploaded parts.
+func (gcs *GoogleCloudStorage) AbortMultipartUpload(ctx context.Context, bucketName, repo, objectID, uploadID string) error {
+	if validUploadID(uploadID) == false {
+		return ErrInvalidUploadID
+	}
+	return gcs.deleteParts(ctx, gcs.client.Bucket(bucketName), gcs.partPrefix(repo, objectID, uploadID))
+}
+
+// validUploadID reports whether id is the upload id which is generated by CreateMultipartUpload.
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
 }
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+const (
+	KeyScopeRepository = "repository"
+	KeyScopeGlobal     = "global"
+)
+
+// KeyLayout builds the key of the object in the bucket.
+// The zero value builds the key as "repo/oid".
+type KeyLayout struct {
+	Prefix string
+	// Shard splits keys by the prefix of oid like "ab/cd/abcdef...".
+	Shard bool
+	// Global stores objects in the content-addressed key space which is shared by all repositories.
+	Global bool
+}
+
+// newKeyLayout returns the layout of the configuration. If conf is nil, def is returned.
+func newKeyLayout(conf *config.KeyLayout, def *KeyLayout) (*KeyLayout, error) {
+	if conf == nil {
+		return def, nil
+	}
+	layout := &KeyLayout{Prefix: strings.Trim(conf.Prefix, "/"), Shard: conf.Shard}
+	switch conf.Scope {
+	case "", KeyScopeRepository:
+	case KeyScopeGlobal:
+		layout.Global = true
+	default:
+		return nil, fmt.Errorf("unknown key scope: %s", conf.Scope)
+	}
+	return layout, nil
+}
+
+func (l *KeyLayout) Key(repo, objectID string) string {
+	s := make([]string, 0, 5)
+	if l.Prefix != "" {
+		s = append(s, l.Prefix)
+	}
+	if l.Global == false {
+		s = append(s, repo)
+	}
+	if l.Shard && len(objectID) > 4 {
+		s = append(s, objectID[:2], objectID[2:4])
+	}
+	return strings.Join(append(s, objectID), "/")
+}
+
+// ListPrefix returns the common prefix of keys of the repository.
+func (l *KeyLayout) ListPrefix(repo string) string {
+	s := make([]string, 0, 2)
+	if l.Prefix != "" {
+		s = append(s, l.Prefix)
+	}
+	if l.Global == false {
+		s = append(s, repo)
+	}
+	if len(s) == 0 {
+		return ""
+	}
+	return strings.Join(s, "/") + "/"
+}
+
+// ObjectID returns the object id of the key. If the key is not the object of the repository, ok is false.
+func (l *KeyLayout) ObjectID(repo, key string) (objectID string, ok bool) {
+	objectID = key[strings.LastIndex(key, "/")+1:]
+	if validObjectID(objectID) == false || l.Key(repo, objectID) != key {
+		return "", false
+	}
+	return objectID, true
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+func TestKeyLayout(t *testing.T) {
+	objectID := "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+	cases := []struct {
+		conf *config.KeyLayout
+		key  string
+	}{
+		{conf: nil, key: "f110/test1/" + objectID},
+		{conf: &config.KeyLayout{Prefix: "/production/"}, key: "production/f110/test1/" + objectID},
+		{conf: &config.KeyLayout{Shard: true}, key: "f110/test1/4d/7a/" + objectID},
+		{conf: &config.KeyLayout{Prefix: "lfs", Shard: true, Scope: KeyScopeGlobal}, key: "lfs/4d/7a/" + objectID},
+	}
+
+	for _, c := range cases {
+		layout, err := newKeyLayout(c.conf, &KeyLayout{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key := layout.Key("f110/test1", objectID); key != c.key {
+			t.Errorf("unexpected key: %s (expected %s)", key, c.key)
+		}
+		if strings.HasPrefix(c.key, layout.ListPrefix("f110/test1")) == false {
+			t.Errorf("unexpected prefix of %s: %s", c.key, layout.ListPrefix("f110/test1"))
+		}
+		if id, ok := layout.ObjectID("f110/test1", c.key); ok == false || id != objectID {
+			t.Errorf("unexpected object id of %s: %s", c.key, id)
+		}
+		if _, ok := layout.ObjectID("f110/test2", c.key); ok && layout.Global == false {
+			t.Errorf("%s is the object of another repository", c.key)
+		}
+	}
+
+	if _, err := newKeyLayout(&config.KeyLayout{Scope: "organization"}, &KeyLayout{}); err == nil {
+		t.Error("unknown scope is accepted")
+	}
+}
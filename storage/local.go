@@ -0,0 +1,437 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+const (
+	localListPageSize = 1000
+)
+
+var (
+	ErrInvalidObjectID = errors.New("invalid object id")
+)
+
+// LocalStorage stores objects on the local filesystem.
+// The object is served by lfs server through LocalStorage.ServeHTTP.
+type LocalStorage struct {
+	dir     string
+	baseURL string
+	signer  *urlSigner
+	expire  time.Duration
+	layout  *KeyLayout
+}
+
+// localConfig is the section of local driver.
+type localConfig struct {
+	// Path is the directory of objects
+	Path string
+}
+
+func init() {
+	Register("local", func(conf *config.Config, repoConf *config.RepositoryConfig, driverConf config.DriverConfig) (Storage, error) {
+		var c localConfig
+		if err := driverConf.Decode(&c); err != nil {
+			return nil, err
+		}
+		if c.Path == "" {
+			return nil, errors.New("path is required")
+		}
+		local, err := NewLocalStorage(c.Path, conf.BaseURL(), []byte(repoConf.SigningKey), urlExpire(repoConf))
+		if err != nil {
+			return nil, err
+		}
+		local.layout, err = newKeyLayout(repoConf.KeyLayout, local.layout)
+		return local, err
+	})
+}
+
+func NewLocalStorage(dir, baseURL string, signingKey []byte, expire time.Duration) (*LocalStorage, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newURLSigner(signingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalStorage{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		signer:  signer,
+		expire:  expire,
+		layout:  &KeyLayout{Shard: true},
+	}, nil
+}
+
+// validObjectID reports whether objectID is the lower hex SHA-256 of the object.
+func validObjectID(objectID string) bool {
+	if len(objectID) != 64 {
+		return false
+	}
+	for _, c := range objectID {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// objectPath returns the path of the object. By default, objects are sharded by the prefix of object id.
+func (local *LocalStorage) objectPath(repo, objectID string) (string, error) {
+	if validObjectID(objectID) == false {
+		return "", ErrInvalidObjectID
+	}
+	return filepath.Join(local.dir, filepath.FromSlash(local.layout.Key(repo, objectID))), nil
+}
+
+func (local *LocalStorage) Get(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	if validObjectID(objectID) == false {
+		return "", ErrInvalidObjectID
+	}
+	return local.signer.Sign(http.MethodGet, local.baseURL, ObjectPathPrefix+repo+"/"+objectID, nil, local.expire), nil
+}
+
+func (local *LocalStorage) GetObject(ctx context.Context, bucketName string, repo string, objectID string) (io.ReadCloser, error) {
+	p, err := local.objectPath(repo, objectID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (local *LocalStorage) GetObjectRange(ctx context.Context, bucketName string, repo string, objectID string, offset, length int64) (io.ReadCloser, error) {
+	r, err := local.GetObject(ctx, bucketName, repo, objectID)
+	if err != nil {
+		return nil, err
+	}
+	f := r.(*os.File)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return &limitReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+func (local *LocalStorage) Put(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	if validObjectID(objectID) == false {
+		return "", ErrInvalidObjectID
+	}
+	return local.signer.Sign(http.MethodPut, local.baseURL, ObjectPathPrefix+repo+"/"+objectID, nil, local.expire), nil
+}
+
+func (local *LocalStorage) PutObject(ctx context.Context, bucketName string, repo string, objectID string) (io.WriteCloser, error) {
+	p, err := local.objectPath(repo, objectID)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+objectID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localFileWriter{File: f, path: p}, nil
+}
+
+func (local *LocalStorage) Stat(ctx context.Context, bucketName string, repo string, objectID string) (*ObjectInfo, error) {
+	p, err := local.objectPath(repo, objectID)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+func (local *LocalStorage) Delete(ctx context.Context, bucketName string, repo string, objectID string) error {
+	p, err := local.objectPath(repo, objectID)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns objects in the order of keys. The cursor is the key of the last returned object.
+func (local *LocalStorage) List(ctx context.Context, bucketName string, repo string, cursor string) ([]*ListedObject, string, error) {
+	root := filepath.Join(local.dir, filepath.FromSlash(local.layout.ListPrefix(repo)))
+	keys := make([]string, 0)
+	objects := make(map[string]*ListedObject)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(local.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		objectID, ok := local.layout.ObjectID(repo, key)
+		if ok == false || key <= cursor {
+			return nil
+		}
+		keys = append(keys, key)
+		objects[key] = &ListedObject{ObjectID: objectID, Size: info.Size(), LastModified: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Strings(keys)
+	next := ""
+	if len(keys) > localListPageSize {
+		keys = keys[:localListPageSize]
+		next = keys[len(keys)-1]
+	}
+	res := make([]*ListedObject, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, objects[k])
+	}
+	return res, next, nil
+}
+
+func (local *LocalStorage) TransferAdapters() []string {
+	return []string{TransferTus, TransferBasic}
+}
+
+// PutResumable returns the URL for the resumable upload by tus protocol.
+func (local *LocalStorage) PutResumable(ctx context.Context, bucketName string, repo string, objectID string, size int64) (string, error) {
+	if validObjectID(objectID) == false {
+		return "", ErrInvalidObjectID
+	}
+	params := url.Values{}
+	params.Set("size", strconv.FormatInt(size, 10))
+	return local.signer.Sign(http.MethodPatch, local.baseURL, ObjectPathPrefix+repo+"/"+objectID, params, local.expire), nil
+}
+
+// tusOffset returns how many bytes of the object have been uploaded.
+func (local *LocalStorage) tusOffset(w http.ResponseWriter, req *http.Request, repo, objectID string) {
+	filePath, err := local.objectPath(repo, objectID)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", req.URL.Query().Get("size"))
+	if info, err := os.Stat(filePath); err == nil {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(info.Size(), 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	offset := int64(0)
+	if info, err := os.Stat(filePath + ".part"); err == nil {
+		offset = info.Size()
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatch appends the request body to the partially uploaded object.
+// When the object reaches the size, the object appears.
+func (local *LocalStorage) tusPatch(w http.ResponseWriter, req *http.Request, repo, objectID string) {
+	filePath, err := local.objectPath(repo, objectID)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	size, err := strconv.ParseInt(req.URL.Query().Get("size"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid size", http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.OpenFile(filePath+".part", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info.Size() != offset {
+		http.Error(w, "offset mismatch", http.StatusConflict)
+		return
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(f, io.LimitReader(req.Body, size-offset))
+	offset += n
+	if err != nil {
+		log.Print(err)
+	}
+	if err := f.Sync(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if offset == size {
+		f.Close()
+		if err := os.Rename(filePath+".part", filePath); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeHTTP serves the object which is requested by the signed URL.
+func (local *LocalStorage) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	method := req.Method
+	if method == http.MethodHead {
+		// HEAD is used for querying the offset of the resumable upload
+		method = http.MethodPatch
+	}
+	if local.signer.Verify(req, method) == false {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	p := strings.TrimPrefix(req.URL.Path, ObjectPathPrefix)
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		http.NotFound(w, req)
+		return
+	}
+	repo, objectID := p[:i], p[i+1:]
+
+	switch req.Method {
+	case http.MethodGet:
+		filePath, err := local.objectPath(repo, objectID)
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		f, err := os.Open(filePath)
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, req, objectID, info.ModTime(), f)
+	case http.MethodPut:
+		writer, err := local.PutObject(req.Context(), "", repo, objectID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err = io.Copy(writer, req.Body)
+		if err != nil {
+			AbortWriter(writer, err)
+			log.Print(err)
+			http.Error(w, "failed to write object", http.StatusInternalServerError)
+			return
+		}
+		err = writer.Close()
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "failed to write object", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		local.tusOffset(w, req, repo, objectID)
+	case http.MethodPatch:
+		local.tusPatch(w, req, repo, objectID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// localFileWriter writes the object to the temporary file and renames it when closed.
+// The object appears atomically.
+type localFileWriter struct {
+	*os.File
+	path string
+}
+
+func (w *localFileWriter) Close() error {
+	err := w.File.Sync()
+	if err != nil {
+		w.CloseWithError(err)
+		return err
+	}
+	err = w.File.Close()
+	if err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	return os.Rename(w.File.Name(), w.path)
+}
+
+// CloseWithError discards the written object.
+func (w *localFileWriter) CloseWithError(err error) error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The object ids of the tests
+var (
+	oid1 = strings.Repeat("1", 64)
+	oid2 = strings.Repeat("2", 64)
+	oid3 = strings.Repeat("3", 64)
+	oid4 = strings.Repeat("4", 64)
+	oid9 = strings.Repeat("9", 64)
+)
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mux := http.NewServeMux()
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	local, err := NewLocalStorage(dir, s.URL, []byte("test"), URLExpire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle(ObjectPathPrefix, local)
+
+	objectID := "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+	content := []byte("hello world")
+
+	t.Run("put", func(t *testing.T) {
+		u, err := local.Put(context.Background(), "", "f110/test1", objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, "f110", "test1", "4d", "7a", objectID)); err != nil {
+			t.Errorf("object is not sharded by prefix: %v", err)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		u, err := local.Get(context.Background(), "", "f110/test1", objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(body, content) == false {
+			t.Errorf("unexpected content: %s", body)
+		}
+	})
+
+	t.Run("invalid_signature", func(t *testing.T) {
+		u, err := local.Get(context.Background(), "", "f110/test1", objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.Get(u + "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("unexpected status code: %d", res.StatusCode)
+		}
+
+		req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("download URL is accepted for upload: %d", res.StatusCode)
+		}
+	})
+	t.Run("delete", func(t *testing.T) {
+		if err := local.Delete(context.Background(), "", "f110/test1", objectID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := local.Stat(context.Background(), "", "f110/test1", objectID); err != ErrObjectNotExist {
+			t.Errorf("object is not deleted: %v", err)
+		}
+		if err := local.Delete(context.Background(), "", "f110/test1", objectID); err != nil {
+			t.Errorf("deleting the object which doesn't exist is failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/database"
+)
+
+const (
+	DefaultMigrateConcurrency = 8
+)
+
+var (
+	errContentMismatch = errors.New("content doesn't match object id")
+)
+
+// MigrationDestination returns the configuration of the storage which the repository is migrated to.
+// If the destination doesn't specify the bucket, the bucket of the repository is used.
+func MigrationDestination(repoConf *config.RepositoryConfig) *config.RepositoryConfig {
+	if repoConf.MigrateTo == nil {
+		return nil
+	}
+	c := *repoConf.MigrateTo
+	c.Owner, c.Repo = repoConf.Owner, repoConf.Repo
+	if c.Bucket == "" {
+		c.Bucket = repoConf.Bucket
+	}
+	if c.SigningKey == "" {
+		c.SigningKey = repoConf.SigningKey
+	}
+	return &c
+}
+
+// Migrated reports whether all key spaces of the repository, including aliases, have been copied to the destination.
+func Migrated(repoConf *config.RepositoryConfig) (bool, error) {
+	if repoConf.MigrateTo == nil {
+		return false, nil
+	}
+	repoName := repoConf.Owner + "/" + repoConf.Repo
+	for _, keySpace := range append([]string{repoName}, repoConf.Aliases...) {
+		m, err := database.ReadMigration(repoName, keySpace)
+		if err == database.ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if m.Completed == false {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// SwitchMigration records that lfs server switched the migrated repository to the destination,
+// and reports whether lfs server still has to read the objects which are missing in the destination from the source.
+// Objects uploaded to the source until the switch are copied by the pass of Migrate which starts after the switch.
+func SwitchMigration(repoConf *config.RepositoryConfig) (bool, error) {
+	repoName := repoConf.Owner + "/" + repoConf.Repo
+	fallback := false
+	for _, keySpace := range append([]string{repoName}, repoConf.Aliases...) {
+		m, err := database.ReadMigration(repoName, keySpace)
+		if err != nil {
+			return false, err
+		}
+		if m.SwitchedAt.IsZero() {
+			m.SwitchedAt = time.Now()
+			if err := database.SaveMigration(m); err != nil {
+				return false, err
+			}
+		}
+		if m.SyncedAt.After(m.SwitchedAt) == false {
+			fallback = true
+		}
+	}
+	return fallback, nil
+}
+
+// Migrate copies objects in the key space from src to dst, and saves the checkpoint in the database after each page.
+// The interrupted migration is resumed from the checkpoint. The content of each object is hashed and compared with its object id.
+//
+// Objects which are uploaded after the key space is listed are not copied. Running Migrate again after the migration
+// has completed copies such objects, and objects which already exist in dst are verified and skipped.
+func Migrate(ctx context.Context, src Storage, srcBucket string, dst Storage, dstBucket string, repo, keySpace string, concurrency int) (*database.Migration, error) {
+	if concurrency <= 0 {
+		concurrency = DefaultMigrateConcurrency
+	}
+
+	m, err := database.ReadMigration(repo, keySpace)
+	if err == database.ErrNotFound {
+		m = &database.Migration{Repo: repo, KeySpace: keySpace}
+	} else if err != nil {
+		return nil, err
+	}
+	if m.Cursor == "" {
+		if m.Completed {
+			// Start the pass which catches up with uploads during the previous pass
+			m.Copied, m.Skipped = 0, 0
+		}
+		m.StartedAt = time.Now()
+	}
+
+	for {
+		objects, next, err := src.List(ctx, srcBucket, keySpace, m.Cursor)
+		if err != nil {
+			return m, err
+		}
+
+		copied, skipped, err := migrateObjects(ctx, src, srcBucket, dst, dstBucket, keySpace, objects, concurrency)
+		if err != nil {
+			// The page is copied again by the next run
+			return m, err
+		}
+		m.Copied += copied
+		m.Skipped += skipped
+		m.Cursor = next
+		if next == "" {
+			m.Completed = true
+			m.SyncedAt = m.StartedAt
+		}
+		if err := database.SaveMigration(m); err != nil {
+			return m, err
+		}
+		if next == "" {
+			return m, nil
+		}
+	}
+}
+
+// migrateObjects copies objects concurrently, and returns the number of copied and skipped objects.
+func migrateObjects(ctx context.Context, src Storage, srcBucket string, dst Storage, dstBucket string, repo string, objects []*ListedObject, concurrency int) (int64, int64, error) {
+	var mu sync.Mutex
+	var copied, skipped int64
+	var firstErr error
+	queue := make(chan *ListedObject)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency && i < len(objects); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for o := range queue {
+				ok, err := MigrateObject(ctx, src, srcBucket, dst, dstBucket, repo, o)
+				mu.Lock()
+				switch {
+				case err != nil && firstErr == nil:
+					firstErr = fmt.Errorf("storage: failed to copy %s: %v", o.ObjectID, err)
+				case err == nil && ok:
+					copied++
+				case err == nil:
+					skipped++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, o := range objects {
+		queue <- o
+	}
+	close(queue)
+	wg.Wait()
+
+	return copied, skipped, firstErr
+}
+
+// MigrateObject copies the object if dst doesn't have the valid object. If the object is copied, MigrateObject returns true.
+func MigrateObject(ctx context.Context, src Storage, srcBucket string, dst Storage, dstBucket string, repo string, o *ListedObject) (bool, error) {
+	info, err := dst.Stat(ctx, dstBucket, repo, o.ObjectID)
+	switch {
+	case err == nil && info.Size == o.Size:
+		err := hashObject(ctx, dst, dstBucket, repo, o.ObjectID)
+		if err == nil {
+			return false, nil
+		}
+		if err != errContentMismatch {
+			return false, err
+		}
+	case err != nil && err != ErrObjectNotExist:
+		return false, err
+	}
+
+	r, err := src.GetObject(ctx, srcBucket, repo, o.ObjectID)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	w, err := dst.PutObject(ctx, dstBucket, repo, o.ObjectID)
+	if err != nil {
+		return false, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err == nil && (n != o.Size || hex.EncodeToString(h.Sum(nil)) != o.ObjectID) {
+		err = errContentMismatch
+	}
+	if err != nil {
+		AbortWriter(w, err)
+		return false, err
+	}
+	return true, w.Close()
+}
+
+// hashObject returns errContentMismatch if the content of the object doesn't match the object id.
+func hashObject(ctx context.Context, s Storage, bucketName, repo, objectID string) error {
+	r, err := s.GetObject(ctx, bucketName, repo, objectID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != objectID {
+		return errContentMismatch
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/database"
+)
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	database.Conn = db
+
+	repoConf := &config.RepositoryConfig{
+		Owner:      "f110",
+		Repo:       "test1",
+		Storage:    "local",
+		SigningKey: "test",
+		Drivers:    map[string]config.DriverConfig{"local": {"path": filepath.Join(dir, "src")}},
+		MigrateTo:  &config.RepositoryConfig{Storage: "local", Drivers: map[string]config.DriverConfig{"local": {"path": filepath.Join(dir, "dst")}}, KeyLayout: &config.KeyLayout{Prefix: "lfs"}},
+	}
+	src, err := Open(&config.Config{}, repoConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := Open(&config.Config{}, MigrationDestination(repoConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	put := func(objectID, content string) {
+		w, err := src.PutObject(ctx, "", "f110/test1", objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oid := func(content string) string {
+		h := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(h[:])
+	}
+	objects := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		content := fmt.Sprintf("object %d", i)
+		objects[oid(content)] = content
+		put(oid(content), content)
+	}
+	// The object is corrupted in the source
+	corrupted := oid("object 20")
+	put(corrupted, "corrupted")
+
+	migrate := func() (*database.Migration, error) {
+		return Migrate(ctx, src, "", dst, "", "f110/test1", "f110/test1", 4)
+	}
+	if _, err := migrate(); err == nil {
+		t.Fatal("corrupted object is copied")
+	}
+	if migrated, _ := Migrated(repoConf); migrated {
+		t.Error("repository is switched before the migration completes")
+	}
+	if _, err := dst.Stat(ctx, "", "f110/test1", corrupted); err != ErrObjectNotExist {
+		t.Errorf("corrupted object is stored: %v", err)
+	}
+
+	put(corrupted, "object 20")
+	objects[corrupted] = "object 20"
+	m, err := migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Completed == false || m.Copied+m.Skipped != int64(len(objects)) {
+		t.Errorf("unexpected migration: %+v", m)
+	}
+	for objectID, content := range objects {
+		r, err := dst.GetObject(ctx, "", "f110/test1", objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(buf) != content {
+			t.Errorf("unexpected content of %s: %s", objectID, buf)
+		}
+	}
+	if migrated, err := Migrated(repoConf); err != nil || migrated == false {
+		t.Errorf("repository is not switched: %v", err)
+	}
+	if fallback, err := SwitchMigration(repoConf); err != nil || fallback == false {
+		t.Errorf("the source is not read after switching: %v", err)
+	}
+
+	// The object which is uploaded during the migration is copied by the next pass
+	put(oid("object 21"), "object 21")
+	m, err = migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Copied != 1 || m.Skipped != int64(len(objects)) {
+		t.Errorf("unexpected migration: %+v", m)
+	}
+	if fallback, err := SwitchMigration(repoConf); err != nil || fallback {
+		t.Errorf("the source is read after the catch-up pass: %v", err)
+	}
+}
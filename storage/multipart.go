@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	DefaultMultipartPartSize = 64 * 1024 * 1024
+)
+
+var (
+	ErrInvalidUploadID = errors.New("invalid upload id")
+	ErrPartsMismatch   = errors.New("uploaded parts are mismatched")
+)
+
+type Part struct {
+	Number int
+	Href   string
+	Method string
+	Header map[string]string
+	Pos    int64
+	Size   int64
+}
+
+type MultipartUpload struct {
+	UploadID string
+	Parts    []Part
+}
+
+// MultipartStorage is implemented by the storage which can upload an object in multiple parts
+// through the presigned URL of each part.
+type MultipartStorage interface {
+	CreateMultipartUpload(ctx context.Context, bucketName, repo, objectID string, size int64) (*MultipartUpload, error)
+	// CompleteMultipartUpload returns ErrPartsMismatch and aborts the upload
+	// if the uploaded parts are not the parts which are returned by CreateMultipartUpload for size.
+	CompleteMultipartUpload(ctx context.Context, bucketName, repo, objectID, uploadID string, size int64) error
+	AbortMultipartUpload(ctx context.Context, bucketName, repo, objectID, uploadID string) error
+}
+
+// splitParts splits the object into parts. each part has partSize bytes except the last part.
+func splitParts(size, partSize int64) []Part {
+	parts := make([]Part, 0)
+	for pos, n := int64(0), 1; pos < size || n == 1; pos, n = pos+partSize, n+1 {
+		s := partSize
+		if size-pos < partSize {
+			s = size - pos
+		}
+		parts = append(parts, Part{Number: n, Pos: pos, Size: s})
+	}
+	return parts
+}
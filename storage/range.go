@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+// RangeStorage is implemented by the storage which can read a part of the object.
+type RangeStorage interface {
+	// GetObjectRange returns the reader of length bytes from offset. If length is negative, the reader continues to the end.
+	GetObjectRange(ctx context.Context, bucketName string, repo string, objectID string, offset, length int64) (io.ReadCloser, error)
+}
+
+type limitReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// GetObjectRange reads a part of the object from s.
+// If s doesn't implement RangeStorage, the head of the object is skipped by reading.
+func GetObjectRange(ctx context.Context, s Storage, bucketName, repo, objectID string, offset, length int64) (io.ReadCloser, error) {
+	if r, ok := s.(RangeStorage); ok {
+		return r.GetObjectRange(ctx, bucketName, repo, objectID, offset, length)
+	}
+
+	r, err := s.GetObject(ctx, bucketName, repo, objectID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return r, nil
+	}
+	return &limitReadCloser{Reader: io.LimitReader(r, length), Closer: r}, nil
+}
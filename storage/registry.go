@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+// Factory creates the storage from the configuration of the repository.
+// driverConf is the section of the driver in the repository, and the factory decodes it into its own configuration.
+type Factory func(conf *config.Config, repoConf *config.RepositoryConfig, driverConf config.DriverConfig) (Storage, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Factory)
+)
+
+// Register makes the storage driver available by name.
+// Register panics if it is called twice with the same name or factory is nil.
+func Register(name string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("storage: Register called twice for driver " + name)
+	}
+	drivers[name] = factory
+}
+
+// Drivers returns the sorted names of the registered drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open creates the storage of the repository by the driver.
+// If the repository doesn't specify the driver, the top-level storage setting is used.
+func Open(conf *config.Config, repoConf *config.RepositoryConfig) (Storage, error) {
+	name := repoConf.Storage
+	if name == "" {
+		name = conf.Storage
+	}
+	if name == "" {
+		return nil, fmt.Errorf("storage: %s/%s: storage is not specified", repoConf.Owner, repoConf.Repo)
+	}
+
+	driversMu.RLock()
+	factory, ok := drivers[name]
+	driversMu.RUnlock()
+	if ok == false {
+		return nil, fmt.Errorf("storage: %s/%s: unknown driver %q (available: %v)", repoConf.Owner, repoConf.Repo, name, Drivers())
+	}
+
+	s, err := factory(conf, repoConf, repoConf.Drivers[name])
+	if err != nil {
+		return nil, fmt.Errorf("storage: %s/%s: %s: %v", repoConf.Owner, repoConf.Repo, name, err)
+	}
+	return s, nil
+}
+
+// urlExpire returns the expiration of the URL which is configured for the repository.
+func urlExpire(repoConf *config.RepositoryConfig) time.Duration {
+	if repoConf.URLExpire.Duration > 0 {
+		return repoConf.URLExpire.Duration
+	}
+	return URLExpire
+}
+
+func init() {
+	Register("nop", func(_ *config.Config, _ *config.RepositoryConfig, _ config.DriverConfig) (Storage, error) {
+		return &Nop{}, nil
+	})
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+func TestOpen(t *testing.T) {
+	conf := &config.Config{Storage: "nop"}
+
+	s, err := Open(conf, &config.RepositoryConfig{Owner: "f110", Repo: "test1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*Nop); ok == false {
+		t.Errorf("top-level storage is not used: %T", s)
+	}
+
+	_, err = Open(conf, &config.RepositoryConfig{Owner: "f110", Repo: "test1", Storage: "gogle"})
+	if err == nil || strings.Contains(err.Error(), `unknown driver "gogle"`) == false {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = Open(conf, &config.RepositoryConfig{Owner: "f110", Repo: "test1", Storage: "local"})
+	if err == nil {
+		t.Error("local storage without path is opened")
+	}
+}
+
+func TestOpen_DriverConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	confFile := filepath.Join(dir, "config.toml")
+	err = ioutil.WriteFile(confFile, []byte(`
+url = "http://localhost"
+
+[repositories]
+    [repositories."f110/test1"]
+    storage = "local"
+    signing_key = "test"
+        [repositories."f110/test1".local]
+        path = "`+filepath.Join(dir, "objects")+`"
+    [repositories."f110/test2"]
+    storage = "local"
+    signing_key = "test"
+        [repositories."f110/test2".local]
+        path = "`+filepath.Join(dir, "objects")+`"
+        part_size = 1024
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := config.Read(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Open(&conf, conf.Repositories["f110/test1"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local, ok := s.(*LocalStorage); ok == false || local.dir != filepath.Join(dir, "objects") {
+		t.Errorf("the section of the driver is not used: %#v", s)
+	}
+
+	_, err = Open(&conf, conf.Repositories["f110/test2"])
+	if err == nil || strings.Contains(err.Error(), "part_size") == false {
+		t.Errorf("unknown option is not rejected: %v", err)
+	}
+
+	err = ioutil.WriteFile(confFile, []byte(`
+[repositories]
+    [repositories."f110/test3"]
+    storage = "s3"
+    region = "ap-northeast-1"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.Read(confFile)
+	if err == nil || strings.Contains(err.Error(), `[repositories."f110/test3".s3]`) == false {
+		t.Errorf("the option in the section of the repository is not rejected: %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/database"
+)
+
+const (
+	replicationPollInterval = 10 * time.Second
+	replicationMinBackoff   = 5 * time.Second
+	replicationMaxBackoff   = 30 * time.Minute
+	replicationBatchSize    = 100
+)
+
+// ReplicatedStorage stores objects in the primary, and copies them to the replicas asynchronously.
+// Copies are queued in the database, so they are resumed after lfs server restarts.
+// If the object is not available in the primary, the object is read from the replicas.
+// The buckets of the primary and the replicas are used instead of the bucket which is passed to each method.
+type ReplicatedStorage struct {
+	primary  *bucketStorage
+	replicas []*bucketStorage
+	queue    string
+	// The job of the object which is not uploaded to the primary within uploadTimeout is dropped
+	uploadTimeout time.Duration
+
+	pollInterval time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	notify       chan struct{}
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+func init() {
+	Register("replicated", func(conf *config.Config, repoConf *config.RepositoryConfig, driverConf config.DriverConfig) (Storage, error) {
+		// The primary and the replicas are configured by backend and replicas
+		if err := driverConf.Decode(&struct{}{}); err != nil {
+			return nil, err
+		}
+		primary, err := openBackend(conf, repoConf, repoConf.Backend)
+		if err != nil {
+			return nil, err
+		}
+		if len(repoConf.Replicas) == 0 {
+			return nil, errors.New("replicas are required")
+		}
+		replicas := make([]*bucketStorage, 0, len(repoConf.Replicas))
+		names := make(map[string]bool)
+		for _, v := range repoConf.Replicas {
+			r, err := openBackend(conf, repoConf, v)
+			if err != nil {
+				return nil, err
+			}
+			// The queued copies refer the replica by the name
+			if names[r.name] {
+				return nil, fmt.Errorf("replica %s is duplicated", r.name)
+			}
+			names[r.name] = true
+			replicas = append(replicas, r)
+		}
+
+		r := newReplicatedStorage(primary, replicas, repoConf.Owner+"/"+repoConf.Repo, urlExpire(repoConf))
+		go r.run()
+		return r, nil
+	})
+}
+
+func newReplicatedStorage(primary *bucketStorage, replicas []*bucketStorage, queue string, uploadTimeout time.Duration) *ReplicatedStorage {
+	return &ReplicatedStorage{
+		primary:       primary,
+		replicas:      replicas,
+		queue:         queue,
+		uploadTimeout: 2 * uploadTimeout,
+		pollInterval:  replicationPollInterval,
+		minBackoff:    replicationMinBackoff,
+		maxBackoff:    replicationMaxBackoff,
+		notify:        make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// available returns the first storage which has the object. The primary is searched first.
+func (r *ReplicatedStorage) available(ctx context.Context, repo, objectID string) (*bucketStorage, *ObjectInfo, error) {
+	info, primaryErr := r.primary.Stat(ctx, r.primary.bucket, repo, objectID)
+	if primaryErr == nil {
+		return r.primary, info, nil
+	}
+	for _, replica := range r.replicas {
+		info, err := replica.Stat(ctx, replica.bucket, repo, objectID)
+		if err == nil {
+			if primaryErr != ErrObjectNotExist {
+				log.Printf("storage: failed to stat %s in the primary. the replica is used: %v", objectID, primaryErr)
+			}
+			return replica, info, nil
+		}
+	}
+	return nil, nil, primaryErr
+}
+
+func (r *ReplicatedStorage) Get(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	s, _, err := r.available(ctx, repo, objectID)
+	if err != nil {
+		return "", err
+	}
+	return s.Get(ctx, s.bucket, repo, objectID)
+}
+
+func (r *ReplicatedStorage) GetObject(ctx context.Context, bucketName string, repo string, objectID string) (io.ReadCloser, error) {
+	s, _, err := r.available(ctx, repo, objectID)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetObject(ctx, s.bucket, repo, objectID)
+}
+
+// Put returns the URL of the primary. The copies are queued before the upload,
+// because lfs server can't know when the client finishes uploading.
+func (r *ReplicatedStorage) Put(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	u, err := r.primary.Put(ctx, r.primary.bucket, repo, objectID)
+	if err != nil || u == "" {
+		return u, err
+	}
+	if err := r.enqueue(repo, objectID); err != nil {
+		return "", err
+	}
+	return u, nil
+}
+
+// UploadHeader returns the headers of the primary because the client uploads the object to the primary.
+func (r *ReplicatedStorage) UploadHeader(ctx context.Context, bucketName string, repo string, objectID string) map[string]string {
+	if h, ok := r.primary.Storage.(HeaderStorage); ok {
+		return h.UploadHeader(ctx, r.primary.bucket, repo, objectID)
+	}
+	return nil
+}
+
+// DownloadHeader returns the headers of the storage which is picked by Get.
+func (r *ReplicatedStorage) DownloadHeader(ctx context.Context, bucketName string, repo string, objectID string) map[string]string {
+	s, _, err := r.available(ctx, repo, objectID)
+	if err != nil {
+		return nil
+	}
+	if h, ok := s.Storage.(HeaderStorage); ok {
+		return h.DownloadHeader(ctx, s.bucket, repo, objectID)
+	}
+	return nil
+}
+
+func (r *ReplicatedStorage) PutObject(ctx context.Context, bucketName string, repo string, objectID string) (io.WriteCloser, error) {
+	w, err := r.primary.PutObject(ctx, r.primary.bucket, repo, objectID)
+	if err != nil {
+		return nil, err
+	}
+	return &replicatedWriter{WriteCloser: w, storage: r, repo: repo, objectID: objectID}, nil
+}
+
+func (r *ReplicatedStorage) Stat(ctx context.Context, bucketName string, repo string, objectID string) (*ObjectInfo, error) {
+	_, info, err := r.available(ctx, repo, objectID)
+	return info, err
+}
+
+// List returns objects in the primary.
+func (r *ReplicatedStorage) List(ctx context.Context, bucketName string, repo string, cursor string) ([]*ListedObject, string, error) {
+	return r.primary.List(ctx, r.primary.bucket, repo, cursor)
+}
+
+// Delete removes the object from the primary and all replicas.
+func (r *ReplicatedStorage) Delete(ctx context.Context, bucketName string, repo string, objectID string) error {
+	for _, s := range append([]*bucketStorage{r.primary}, r.replicas...) {
+		if err := s.Delete(ctx, s.bucket, repo, objectID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ReplicatedStorage) TransferAdapters() []string {
+	return []string{TransferBasic}
+}
+
+// ServeHTTP passes the request to the primary if the primary serves objects by itself.
+// The replica which serves objects by itself can't be used for failover of the download.
+func (r *ReplicatedStorage) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h, ok := r.primary.Storage.(http.Handler)
+	if ok == false {
+		http.NotFound(w, req)
+		return
+	}
+	h.ServeHTTP(w, req)
+}
+
+func (r *ReplicatedStorage) enqueue(repo, objectID string) error {
+	now := time.Now()
+	jobs := make([]*database.ReplicationJob, 0, len(r.replicas))
+	for _, v := range r.replicas {
+		jobs = append(jobs, &database.ReplicationJob{Replica: v.name, Repo: repo, ObjectID: objectID, NextAttempt: now, CreatedAt: now})
+	}
+	if err := database.EnqueueReplication(r.queue, jobs...); err != nil {
+		return err
+	}
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close stops copying objects. The queued copies are resumed by the next start.
+func (r *ReplicatedStorage) Close() error {
+	close(r.stop)
+	<-r.done
+	return nil
+}
+
+func (r *ReplicatedStorage) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		r.replicate()
+
+		select {
+		case <-r.stop:
+			return
+		case <-r.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// replicate processes the jobs which should be attempted by now.
+func (r *ReplicatedStorage) replicate() {
+	for {
+		jobs, err := database.ReadReplicationJobs(r.queue, time.Now(), replicationBatchSize)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if len(jobs) == 0 {
+			return
+		}
+
+		for _, job := range jobs {
+			select {
+			case <-r.stop:
+				return
+			default:
+			}
+
+			err := r.copy(job)
+			switch {
+			case err == nil:
+				err = database.DeleteReplicationJob(r.queue, job)
+			case err == ErrObjectNotExist && time.Since(job.CreatedAt) > r.uploadTimeout:
+				// The client gave up uploading the object
+				err = database.DeleteReplicationJob(r.queue, job)
+			default:
+				if err != ErrObjectNotExist {
+					log.Printf("storage: failed to copy %s to replica %s: %v", job.ObjectID, job.Replica, err)
+				}
+				job.Attempts++
+				job.NextAttempt = time.Now().Add(r.backoff(job.Attempts))
+				err = database.UpdateReplicationJob(r.queue, job)
+			}
+			if err != nil {
+				log.Print(err)
+				return
+			}
+		}
+	}
+}
+
+func (r *ReplicatedStorage) backoff(attempts int) time.Duration {
+	d := r.minBackoff
+	for i := 1; i < attempts && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	return d
+}
+
+// copy copies the object from the primary to the replica of the job.
+func (r *ReplicatedStorage) copy(job *database.ReplicationJob) error {
+	var replica *bucketStorage
+	for _, v := range r.replicas {
+		if v.name == job.Replica {
+			replica = v
+		}
+	}
+	if replica == nil {
+		// The replica has been removed from the configuration
+		return nil
+	}
+	ctx := context.Background()
+
+	info, err := r.primary.Stat(ctx, r.primary.bucket, job.Repo, job.ObjectID)
+	if err != nil {
+		return err
+	}
+	if replicaInfo, err := replica.Stat(ctx, replica.bucket, job.Repo, job.ObjectID); err == nil && replicaInfo.Size == info.Size {
+		return nil
+	}
+
+	src, err := r.primary.GetObject(ctx, r.primary.bucket, job.Repo, job.ObjectID)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := replica.PutObject(ctx, replica.bucket, job.Repo, job.ObjectID)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		AbortWriter(dst, err)
+		return err
+	}
+	return dst.Close()
+}
+
+// replicatedWriter queues the copies when the object is written to the primary.
+type replicatedWriter struct {
+	io.WriteCloser
+	storage  *ReplicatedStorage
+	repo     string
+	objectID string
+}
+
+func (w *replicatedWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.storage.enqueue(w.repo, w.objectID)
+}
+
+func (w *replicatedWriter) CloseWithError(err error) error {
+	return AbortWriter(w.WriteCloser, err)
+}
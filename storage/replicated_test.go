@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/f110/git-lfs-cloud/config"
+	"github.com/f110/git-lfs-cloud/database"
+)
+
+// failingStorage fails to write objects until fail is cleared.
+type failingStorage struct {
+	Storage
+	fail int32
+}
+
+func (f *failingStorage) PutObject(ctx context.Context, bucketName, repo, objectID string) (io.WriteCloser, error) {
+	if atomic.LoadInt32(&f.fail) == 1 {
+		return nil, errors.New("unavailable")
+	}
+	return f.Storage.PutObject(ctx, bucketName, repo, objectID)
+}
+
+func TestReplicatedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicated_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	database.Conn = db
+
+	open := func(name string) Storage {
+		s, err := Open(&config.Config{}, &config.RepositoryConfig{Owner: "f110", Repo: "test1", Storage: "local", SigningKey: "test", Drivers: map[string]config.DriverConfig{"local": {"path": filepath.Join(dir, name)}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	primary := &bucketStorage{Storage: open("primary")}
+	replica := &failingStorage{Storage: open("replica")}
+	r := newReplicatedStorage(primary, []*bucketStorage{{Storage: replica, name: "local/replica"}}, "f110/test1", time.Minute)
+	r.pollInterval = 10 * time.Millisecond
+	r.minBackoff = 10 * time.Millisecond
+	r.maxBackoff = 20 * time.Millisecond
+	go r.run()
+	defer r.Close()
+
+	ctx := context.Background()
+	waitReplica := func(objectID string) {
+		for i := 0; i < 200; i++ {
+			if _, err := replica.Stat(ctx, "", "f110/test1", objectID); err == nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%s is not replicated", objectID)
+	}
+	put := func(objectID, content string) {
+		w, err := r.PutObject(ctx, "", "f110/test1", objectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("replicate", func(t *testing.T) {
+		put(oid1, "hello replica")
+		waitReplica(oid1)
+
+		jobs, err := database.ReadReplicationJobs("f110/test1", time.Now(), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) != 0 {
+			t.Errorf("unexpected number of jobs: %d", len(jobs))
+		}
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(dir, "primary", "f110", "test1", "11", "11", oid1)); err != nil {
+			t.Fatal(err)
+		}
+		info, err := r.Stat(ctx, "", "f110/test1", oid1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len("hello replica")) {
+			t.Errorf("unexpected size: %d", info.Size)
+		}
+		reader, err := r.GetObject(ctx, "", "f110/test1", oid1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if string(buf) != "hello replica" {
+			t.Errorf("unexpected content: %s", buf)
+		}
+
+		if _, err := r.Stat(ctx, "", "f110/test1", oid9); err != ErrObjectNotExist {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		atomic.StoreInt32(&replica.fail, 1)
+		put(oid2, "retried")
+
+		var job *database.ReplicationJob
+		for i := 0; i < 200 && job == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+			jobs, err := database.ReadReplicationJobs("f110/test1", time.Now().Add(time.Hour), 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(jobs) == 1 && jobs[0].Attempts > 1 {
+				job = jobs[0]
+			}
+		}
+		if job == nil {
+			t.Fatal("failed copy is not retried")
+		}
+
+		atomic.StoreInt32(&replica.fail, 0)
+		waitReplica(oid2)
+	})
+}
+
+func TestReplicatedStorage_Backoff(t *testing.T) {
+	r := newReplicatedStorage(nil, nil, "", time.Minute)
+	cases := []struct {
+		Attempts int
+		Expected time.Duration
+	}{
+		{Attempts: 1, Expected: replicationMinBackoff},
+		{Attempts: 2, Expected: 2 * replicationMinBackoff},
+		{Attempts: 4, Expected: 8 * replicationMinBackoff},
+		{Attempts: 100, Expected: replicationMaxBackoff},
+	}
+	for _, c := range cases {
+		if d := r.backoff(c.Attempts); d != c.Expected {
+			t.Errorf("unexpected backoff of %d attempts: %v (expected %v)", c.Attempts, d, c.Expected)
+		}
+	}
+}
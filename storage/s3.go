@@ -1,39 +1,171 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
 	"io"
-
-	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+const (
+	s3MaxParts = 10000
 )
 
 type AmazonS3 struct {
-	client s3iface.S3API
+	client   s3iface.S3API
+	uploader *s3manager.Uploader
+	expire   time.Duration
+	partSize int64
+	layout   *KeyLayout
+	sse      *Encryption
+}
+
+// s3Config is the section of s3 driver.
+type s3Config struct {
+	Region string
+	// Endpoint, PathStyle, credentials and TLS settings are used by S3 compatible storage
+	Endpoint           string
+	PathStyle          bool   `toml:"path_style"`
+	AccessKeyID        string `toml:"access_key_id"`
+	SecretAccessKey    string `toml:"secret_access_key"`
+	Profile            string
+	CAFile             string `toml:"ca_file"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+	// PartSize and UploadConcurrency are used by multipart upload
+	PartSize          int64 `toml:"part_size"`
+	UploadConcurrency int   `toml:"upload_concurrency"`
+	encryptionConfig
+}
+
+func init() {
+	Register("s3", func(_ *config.Config, repoConf *config.RepositoryConfig, driverConf config.DriverConfig) (Storage, error) {
+		var c s3Config
+		if err := driverConf.Decode(&c); err != nil {
+			return nil, err
+		}
+		opt := S3Options{
+			Region:             c.Region,
+			Endpoint:           c.Endpoint,
+			PathStyle:          c.PathStyle,
+			AccessKeyID:        c.AccessKeyID,
+			SecretAccessKey:    c.SecretAccessKey,
+			Profile:            c.Profile,
+			CAFile:             c.CAFile,
+			InsecureSkipVerify: c.InsecureSkipVerify,
+		}
+		amazonS3, err := NewAmazonS3(opt, urlExpire(repoConf), c.PartSize, c.UploadConcurrency)
+		if err != nil {
+			return nil, err
+		}
+		amazonS3.layout, err = newKeyLayout(repoConf.KeyLayout, amazonS3.layout)
+		if err != nil {
+			return nil, err
+		}
+		amazonS3.sse, err = newEncryption(c.encryptionConfig, EncryptionSSES3, EncryptionSSEKMS, EncryptionSSEC)
+		return amazonS3, err
+	})
 }
 
-func NewAmazonS3(region string) *AmazonS3 {
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(region)},
-	)
+// S3Options is the options for connecting to S3 or S3 compatible storage (e.g. MinIO, Ceph).
+type S3Options struct {
+	Region string
+	// Endpoint is the URL of S3 compatible storage. If empty, the endpoint of AWS is used.
+	Endpoint  string
+	PathStyle bool
+	// If AccessKeyID is empty, the credentials are read from Profile or the environment.
+	AccessKeyID        string
+	SecretAccessKey    string
+	Profile            string
+	CAFile             string
+	InsecureSkipVerify bool
+}
+
+func NewAmazonS3(opt S3Options, expire time.Duration, partSize int64, concurrency int) (*AmazonS3, error) {
+	awsConf := aws.Config{Region: aws.String(opt.Region)}
+	if opt.Endpoint != "" {
+		awsConf.Endpoint = aws.String(opt.Endpoint)
+		if opt.Region == "" {
+			// Most of S3 compatible storages ignore the region but the signature requires it
+			awsConf.Region = aws.String("us-east-1")
+		}
+	}
+	if opt.PathStyle {
+		awsConf.S3ForcePathStyle = aws.Bool(true)
+	}
+	if opt.AccessKeyID != "" {
+		awsConf.Credentials = credentials.NewStaticCredentials(opt.AccessKeyID, opt.SecretAccessKey, "")
+	}
+	if opt.InsecureSkipVerify {
+		awsConf.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+	}
+
+	sessOpt := session.Options{Config: awsConf, Profile: opt.Profile}
+	if opt.Profile != "" {
+		sessOpt.SharedConfigState = session.SharedConfigEnable
+	}
+	if opt.CAFile != "" {
+		// CustomCABundle has priority over AWS_CA_BUNDLE
+		b, err := ioutil.ReadFile(opt.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		sessOpt.CustomCABundle = bytes.NewReader(b)
+	}
+	sess, err := session.NewSessionWithOptions(sessOpt)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	svs := s3.New(sess)
 
-	return &AmazonS3{client: svs}
+	return newAmazonS3(svs, expire, partSize, concurrency), nil
+}
+
+func newAmazonS3(client s3iface.S3API, expire time.Duration, partSize int64, concurrency int) *AmazonS3 {
+	uploader := s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+		if partSize > 0 {
+			u.PartSize = partSize
+		}
+		if concurrency > 0 {
+			u.Concurrency = concurrency
+		}
+		u.LeavePartsOnError = false
+	})
+
+	if partSize <= 0 {
+		partSize = DefaultMultipartPartSize
+	}
+	return &AmazonS3{client: client, uploader: uploader, expire: expire, partSize: partSize, layout: &KeyLayout{}}
 }
 
-func (amazonS3 *AmazonS3) Get(bucketName string, repo string, objectID string) (string, error) {
+func (amazonS3 *AmazonS3) Get(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	algorithm, customerKey := amazonS3.customerKey()
 	req, _ := amazonS3.client.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(repo + "/" + objectID),
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(amazonS3.layout.Key(repo, objectID)),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
 	})
-	u, err := req.Presign(URLExpire)
+	req.SetContext(ctx)
+	u, err := req.Presign(amazonS3.expire)
 	if err != nil {
 		return "", err
 	}
@@ -42,9 +174,36 @@ func (amazonS3 *AmazonS3) Get(bucketName string, repo string, objectID string) (
 }
 
 func (amazonS3 *AmazonS3) GetObject(ctx context.Context, bucketName string, repo string, objectID string) (io.ReadCloser, error) {
+	algorithm, customerKey := amazonS3.customerKey()
 	res, err := amazonS3.client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(repo + "/" + objectID),
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(amazonS3.layout.Key(repo, objectID)),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (amazonS3 *AmazonS3) GetObjectRange(ctx context.Context, bucketName string, repo string, objectID string, offset, length int64) (io.ReadCloser, error) {
+	// The range of zero bytes can't be represented, and S3 returns the whole object for the invalid range
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	r := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		r += strconv.FormatInt(offset+length-1, 10)
+	}
+	algorithm, customerKey := amazonS3.customerKey()
+	res, err := amazonS3.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(amazonS3.layout.Key(repo, objectID)),
+		Range:                aws.String(r),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
 	})
 	if err != nil {
 		return nil, err
@@ -53,12 +212,19 @@ func (amazonS3 *AmazonS3) GetObject(ctx context.Context, bucketName string, repo
 	return res.Body, nil
 }
 
-func (amazonS3 *AmazonS3) Put(bucketName string, repo string, objectID string) (string, error) {
+func (amazonS3 *AmazonS3) Put(ctx context.Context, bucketName string, repo string, objectID string) (string, error) {
+	sse, kmsKeyID := amazonS3.serverSideEncryption()
+	algorithm, customerKey := amazonS3.customerKey()
 	req, _ := amazonS3.client.PutObjectRequest(&s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(repo + "/" + objectID),
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(amazonS3.layout.Key(repo, objectID)),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
 	})
-	u, err := req.Presign(URLExpire)
+	req.SetContext(ctx)
+	u, err := req.Presign(amazonS3.expire)
 	if err != nil {
 		return "", err
 	}
@@ -66,22 +232,263 @@ func (amazonS3 *AmazonS3) Put(bucketName string, repo string, objectID string) (
 	return u, nil
 }
 
+// PutObject returns the writer which streams the object to S3 by multipart upload.
+// The result of the upload is returned by Close. If the writer is closed by CloseWithError, the upload is aborted.
 func (amazonS3 *AmazonS3) PutObject(ctx context.Context, bucketName string, repo string, objectID string) (io.WriteCloser, error) {
+	sse, kmsKeyID := amazonS3.serverSideEncryption()
+	algorithm, customerKey := amazonS3.customerKey()
 	r, w := io.Pipe()
-	buffer := bytes.NewBuffer([]byte{})
+	writer := &s3ObjectWriter{PipeWriter: w, done: make(chan struct{})}
 	go func() {
-		io.Copy(buffer, r)
+		defer close(writer.done)
 
-		buf := bytes.NewReader(buffer.Bytes())
-		_, err := amazonS3.client.PutObject(&s3.PutObjectInput{
-			Bucket: aws.String(bucketName),
-			Key:    aws.String(repo + "/" + objectID),
-			Body:   buf,
+		_, err := amazonS3.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket:               aws.String(bucketName),
+			Key:                  aws.String(amazonS3.layout.Key(repo, objectID)),
+			Body:                 r,
+			ServerSideEncryption: sse,
+			SSEKMSKeyId:          kmsKeyID,
+			SSECustomerAlgorithm: algorithm,
+			SSECustomerKey:       customerKey,
 		})
 		if err != nil {
+			// Unblock the writer which is still writing the object.
+			r.CloseWithError(err)
+			writer.err = err
 			return
 		}
+		r.Close()
 	}()
 
-	return w, nil
+	return writer, nil
+}
+
+// serverSideEncryption returns the parameters of SSE-S3 or SSE-KMS which are specified on the upload.
+func (amazonS3 *AmazonS3) serverSideEncryption() (*string, *string) {
+	if amazonS3.sse == nil {
+		return nil, nil
+	}
+	switch amazonS3.sse.Mode {
+	case EncryptionSSES3:
+		return aws.String(s3.ServerSideEncryptionAes256), nil
+	case EncryptionSSEKMS:
+		if amazonS3.sse.KMSKeyID == "" {
+			// The default key of S3 is used
+			return aws.String(s3.ServerSideEncryptionAwsKms), nil
+		}
+		return aws.String(s3.ServerSideEncryptionAwsKms), aws.String(amazonS3.sse.KMSKeyID)
+	}
+	return nil, nil
+}
+
+// customerKey returns the parameters of SSE-C which are required by all requests to the object.
+// The key is encoded by SDK.
+func (amazonS3 *AmazonS3) customerKey() (*string, *string) {
+	if amazonS3.sse == nil || amazonS3.sse.Mode != EncryptionSSEC {
+		return nil, nil
+	}
+	return aws.String(s3.ServerSideEncryptionAes256), aws.String(string(amazonS3.sse.CustomerKey))
+}
+
+func (amazonS3 *AmazonS3) customerKeyHeader() map[string]string {
+	if amazonS3.sse == nil || amazonS3.sse.Mode != EncryptionSSEC {
+		return nil
+	}
+	return map[string]string{
+		"x-amz-server-side-encryption-customer-algorithm": s3.ServerSideEncryptionAes256,
+		"x-amz-server-side-encryption-customer-key":       base64.StdEncoding.EncodeToString(amazonS3.sse.CustomerKey),
+		"x-amz-server-side-encryption-customer-key-MD5":   amazonS3.sse.customerKeyMD5(),
+	}
+}
+
+// UploadHeader returns the headers of server-side encryption which are signed in the URL.
+// Note that the key of SSE-C is passed to the client because the client sends the object to S3 directly.
+func (amazonS3 *AmazonS3) UploadHeader(ctx context.Context, bucketName string, repo string, objectID string) map[string]string {
+	header := amazonS3.customerKeyHeader()
+	sse, kmsKeyID := amazonS3.serverSideEncryption()
+	if sse == nil {
+		return header
+	}
+	header = map[string]string{"x-amz-server-side-encryption": *sse}
+	if kmsKeyID != nil {
+		header["x-amz-server-side-encryption-aws-kms-key-id"] = *kmsKeyID
+	}
+	return header
+}
+
+func (amazonS3 *AmazonS3) DownloadHeader(ctx context.Context, bucketName string, repo string, objectID string) map[string]string {
+	return amazonS3.customerKeyHeader()
+}
+
+type s3ObjectWriter struct {
+	*io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func (w *s3ObjectWriter) Close() error {
+	w.PipeWriter.Close()
+	<-w.done
+	return w.err
+}
+
+func (w *s3ObjectWriter) CloseWithError(err error) error {
+	w.PipeWriter.CloseWithError(err)
+	<-w.done
+	return w.err
+}
+
+func (amazonS3 *AmazonS3) Stat(ctx context.Context, bucketName string, repo string, objectID string) (*ObjectInfo, error) {
+	algorithm, customerKey := amazonS3.customerKey()
+	res, err := amazonS3.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(amazonS3.layout.Key(repo, objectID)),
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
+	})
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+		return nil, ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{Size: aws.Int64Value(res.ContentLength), LastModified: aws.TimeValue(res.LastModified)}, nil
+}
+
+func (amazonS3 *AmazonS3) Delete(ctx context.Context, bucketName string, repo string, objectID string) error {
+	_, err := amazonS3.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(amazonS3.layout.Key(repo, objectID)),
+	})
+	return err
+}
+
+// List returns objects by ListObjectsV2. The cursor is the continuation token.
+func (amazonS3 *AmazonS3) List(ctx context.Context, bucketName string, repo string, cursor string) ([]*ListedObject, string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+		Prefix: aws.String(amazonS3.layout.ListPrefix(repo)),
+	}
+	if cursor != "" {
+		input.ContinuationToken = aws.String(cursor)
+	}
+	res, err := amazonS3.client.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	objects := make([]*ListedObject, 0, len(res.Contents))
+	for _, v := range res.Contents {
+		objectID, ok := amazonS3.layout.ObjectID(repo, aws.StringValue(v.Key))
+		if ok == false {
+			continue
+		}
+		objects = append(objects, &ListedObject{ObjectID: objectID, Size: aws.Int64Value(v.Size), LastModified: aws.TimeValue(v.LastModified)})
+	}
+	if aws.BoolValue(res.IsTruncated) == false {
+		return objects, "", nil
+	}
+	return objects, aws.StringValue(res.NextContinuationToken), nil
+}
+
+func (amazonS3 *AmazonS3) TransferAdapters() []string {
+	return []string{TransferMultipart, TransferBasic}
+}
+
+func (amazonS3 *AmazonS3) CreateMultipartUpload(ctx context.Context, bucketName, repo, objectID string, size int64) (*MultipartUpload, error) {
+	sse, kmsKeyID := amazonS3.serverSideEncryption()
+	algorithm, customerKey := amazonS3.customerKey()
+	res, err := amazonS3.client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(amazonS3.layout.Key(repo, objectID)),
+		ServerSideEncryption: sse,
+		SSEKMSKeyId:          kmsKeyID,
+		SSECustomerAlgorithm: algorithm,
+		SSECustomerKey:       customerKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	parts := splitParts(size, amazonS3.multipartPartSize(size))
+	for i := range parts {
+		req, _ := amazonS3.client.UploadPartRequest(&s3.UploadPartInput{
+			Bucket:               aws.String(bucketName),
+			Key:                  aws.String(amazonS3.layout.Key(repo, objectID)),
+			UploadId:             res.UploadId,
+			PartNumber:           aws.Int64(int64(parts[i].Number)),
+			SSECustomerAlgorithm: algorithm,
+			SSECustomerKey:       customerKey,
+		})
+		req.SetContext(ctx)
+		u, err := req.Presign(amazonS3.expire)
+		if err != nil {
+			amazonS3.AbortMultipartUpload(ctx, bucketName, repo, objectID, aws.StringValue(res.UploadId))
+			return nil, err
+		}
+		parts[i].Href = u
+		parts[i].Method = http.MethodPut
+		parts[i].Header = amazonS3.customerKeyHeader()
+	}
+
+	return &MultipartUpload{UploadID: aws.StringValue(res.UploadId), Parts: parts}, nil
+}
+
+// multipartPartSize returns the size of parts of the object. The part size is enlarged so that the parts don't exceed s3MaxParts.
+func (amazonS3 *AmazonS3) multipartPartSize(size int64) int64 {
+	partSize := amazonS3.partSize
+	if size/partSize >= s3MaxParts {
+		partSize = size/s3MaxParts + 1
+	}
+	return partSize
+}
+
+// CompleteMultipartUpload completes the upload with the parts which are uploaded by the client.
+// S3 completes the upload even if some parts are missing, so the parts are checked before the completion.
+func (amazonS3 *AmazonS3) CompleteMultipartUpload(ctx context.Context, bucketName, repo, objectID, uploadID string, size int64) error {
+	expected := splitParts(size, amazonS3.multipartPartSize(size))
+	completed := make([]*s3.CompletedPart, 0)
+	mismatched := false
+	err := amazonS3.client.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(amazonS3.layout.Key(repo, objectID)),
+		UploadId: aws.String(uploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			i := len(completed)
+			if i >= len(expected) || aws.Int64Value(p.PartNumber) != int64(expected[i].Number) || aws.Int64Value(p.Size) != expected[i].Size {
+				mismatched = true
+				return false
+			}
+			completed = append(completed, &s3.CompletedPart{ETag: p.ETag, PartNumber: p.PartNumber})
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if mismatched || len(completed) != len(expected) {
+		if err := amazonS3.AbortMultipartUpload(ctx, bucketName, repo, objectID, uploadID); err != nil {
+			log.Print(err)
+		}
+		return ErrPartsMismatch
+	}
+
+	_, err = amazonS3.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucketName),
+		Key:             aws.String(amazonS3.layout.Key(repo, objectID)),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+func (amazonS3 *AmazonS3) AbortMultipartUpload(ctx context.Context, bucketName, repo, objectID, uploadID string) error {
+	_, err := amazonS3.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(amazonS3.layout.Key(repo, objectID)),
+		UploadId: aws.String(uploadID),
+	})
+	return err
 }
@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// mockS3Multipart records multipart uploads.
+type mockS3Multipart struct {
+	s3iface.S3API
+
+	mu             sync.Mutex
+	parts          map[int64][]byte
+	completed      bool
+	completedParts []*s3.CompletedPart
+	aborted        bool
+	failPart       int64
+	// listedParts are returned by ListParts in 2 pages
+	listedParts []*s3.Part
+}
+
+func newMockS3Multipart() *mockS3Multipart {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("ap-northeast-1"),
+		Credentials: credentials.NewStaticCredentials("access-key", "secret-key", ""),
+	}))
+	return &mockS3Multipart{S3API: s3.New(sess), parts: make(map[int64][]byte)}
+}
+
+func (m *mockS3Multipart) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-id")}, nil
+}
+
+func (m *mockS3Multipart) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	if *input.PartNumber == m.failPart {
+		return nil, errors.New("failed to upload part")
+	}
+	buf, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.parts[*input.PartNumber] = buf
+	m.mu.Unlock()
+	return &s3.UploadPartOutput{ETag: aws.String("etag")}, nil
+}
+
+func (m *mockS3Multipart) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	m.completed = true
+	m.completedParts = input.MultipartUpload.Parts
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3Multipart) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	m.aborted = true
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (m *mockS3Multipart) ListPartsPagesWithContext(ctx aws.Context, input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool, opts ...request.Option) error {
+	half := len(m.listedParts) / 2
+	if fn(&s3.ListPartsOutput{Parts: m.listedParts[:half]}, false) {
+		fn(&s3.ListPartsOutput{Parts: m.listedParts[half:]}, true)
+	}
+	return nil
+}
+
+func (m *mockS3Multipart) object() []byte {
+	keys := make([]int, 0, len(m.parts))
+	for k := range m.parts {
+		keys = append(keys, int(k))
+	}
+	sort.Ints(keys)
+	buf := make([]byte, 0)
+	for _, k := range keys {
+		buf = append(buf, m.parts[int64(k)]...)
+	}
+	return buf
+}
+
+func TestAmazonS3_PutObject(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), int(s3manager.MinUploadPartSize)*2/16+1024)
+
+	t.Run("multipart", func(t *testing.T) {
+		mock := newMockS3Multipart()
+		amazonS3 := newAmazonS3(mock, time.Minute, s3manager.MinUploadPartSize, 2)
+
+		w, err := amazonS3.PutObject(context.Background(), "bucket", "f110/test1", "oid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(mock.parts) != 3 {
+			t.Errorf("unexpected number of parts: %d", len(mock.parts))
+		}
+		if mock.completed == false {
+			t.Error("multipart upload is not completed")
+		}
+		if bytes.Equal(mock.object(), content) == false {
+			t.Error("uploaded object is mismatched")
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		mock := newMockS3Multipart()
+		mock.failPart = 2
+		amazonS3 := newAmazonS3(mock, time.Minute, s3manager.MinUploadPartSize, 1)
+
+		w, err := amazonS3.PutObject(context.Background(), "bucket", "f110/test1", "oid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+		if err := w.Close(); err == nil {
+			t.Error("Close does not return the error of upload")
+		}
+		if mock.completed {
+			t.Error("failed upload is completed")
+		}
+		if mock.aborted == false {
+			t.Error("failed upload is not aborted")
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		mock := newMockS3Multipart()
+		amazonS3 := newAmazonS3(mock, time.Minute, s3manager.MinUploadPartSize, 1)
+
+		w, err := amazonS3.PutObject(context.Background(), "bucket", "f110/test1", "oid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content[:s3manager.MinUploadPartSize+1]); err != nil {
+			t.Fatal(err)
+		}
+		if err := AbortWriter(w, errors.New("abort")); err == nil {
+			t.Error("aborted upload is succeeded")
+		}
+		if mock.completed {
+			t.Error("aborted upload is completed")
+		}
+		if mock.aborted == false {
+			t.Error("incomplete multipart upload is not aborted")
+		}
+	})
+}
+
+func TestAmazonS3_MultipartUpload(t *testing.T) {
+	mock := newMockS3Multipart()
+	amazonS3 := newAmazonS3(mock, time.Minute, 10, 1)
+
+	upload, err := amazonS3.CreateMultipartUpload(context.Background(), "bucket", "f110/test1", "oid", 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.UploadID != "upload-id" {
+		t.Errorf("unexpected upload id: %s", upload.UploadID)
+	}
+	if len(upload.Parts) != 3 {
+		t.Fatalf("unexpected number of parts: %d", len(upload.Parts))
+	}
+	for i, p := range upload.Parts {
+		if p.Number != i+1 || p.Pos != int64(i*10) {
+			t.Errorf("unexpected part: %v", p)
+		}
+		u, err := url.Parse(p.Href)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Query().Get("uploadId") != "upload-id" || u.Query().Get("partNumber") != strconv.Itoa(i+1) {
+			t.Errorf("href is not presigned for the part: %s", p.Href)
+		}
+	}
+	if upload.Parts[2].Size != 5 {
+		t.Errorf("unexpected size of the last part: %d", upload.Parts[2].Size)
+	}
+
+	// The last part is missing
+	mock.listedParts = []*s3.Part{
+		{PartNumber: aws.Int64(1), ETag: aws.String("etag1"), Size: aws.Int64(10)},
+		{PartNumber: aws.Int64(2), ETag: aws.String("etag2"), Size: aws.Int64(10)},
+	}
+	err = amazonS3.CompleteMultipartUpload(context.Background(), "bucket", "f110/test1", "oid", upload.UploadID, 25)
+	if err != ErrPartsMismatch || mock.completed || mock.aborted == false {
+		t.Errorf("multipart upload with the missing part is not aborted: %v", err)
+	}
+
+	mock.aborted = false
+	mock.listedParts = append(mock.listedParts, &s3.Part{PartNumber: aws.Int64(3), ETag: aws.String("etag3"), Size: aws.Int64(5)})
+	err = amazonS3.CompleteMultipartUpload(context.Background(), "bucket", "f110/test1", "oid", upload.UploadID, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mock.completed == false || mock.aborted || len(mock.completedParts) != 3 {
+		t.Errorf("multipart upload is not completed with all parts: %v", mock.completedParts)
+	}
+}
+
+func TestAmazonS3_CompatibleEndpoint(t *testing.T) {
+	var path, authorization string
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		authorization = req.Header.Get("Authorization")
+		w.Header().Set("Content-Length", "11")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	f.Close()
+
+	amazonS3, err := NewAmazonS3(S3Options{
+		Endpoint:        s.URL,
+		PathStyle:       true,
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio-secret",
+		CAFile:          f.Name(),
+	}, URLExpire, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := amazonS3.Stat(context.Background(), "lfs", "f110/test1", "1234567890")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 11 {
+		t.Errorf("unexpected size: %d", info.Size)
+	}
+	if path != "/lfs/f110/test1/1234567890" {
+		t.Errorf("bucket is not in the path: %s", path)
+	}
+	if strings.Contains(authorization, "Credential=minio/") == false {
+		t.Errorf("static credentials are not used: %s", authorization)
+	}
+
+	u, err := amazonS3.Get(context.Background(), "lfs", "f110/test1", "1234567890")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(u, s.URL+"/lfs/f110/test1/1234567890?") == false {
+		t.Errorf("unexpected url: %s", u)
+	}
+}
+
+func TestAmazonS3_Encryption(t *testing.T) {
+	var header http.Header
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		w.Header().Set("Content-Length", "11")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	f.Close()
+
+	newStorage := func(conf encryptionConfig) *AmazonS3 {
+		amazonS3, err := NewAmazonS3(S3Options{Endpoint: s.URL, PathStyle: true, AccessKeyID: "minio", SecretAccessKey: "minio-secret", CAFile: f.Name()}, URLExpire, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		amazonS3.sse, err = newEncryption(conf, EncryptionSSES3, EncryptionSSEKMS, EncryptionSSEC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return amazonS3
+	}
+
+	t.Run("sse-kms", func(t *testing.T) {
+		amazonS3 := newStorage(encryptionConfig{Encryption: EncryptionSSEKMS, KMSKeyID: "alias/lfs"})
+		u, err := amazonS3.Put(context.Background(), "lfs", "f110/test1", "1234567890")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(u, "x-amz-server-side-encryption-aws-kms-key-id") == false {
+			t.Errorf("encryption headers are not signed: %s", u)
+		}
+		h := amazonS3.UploadHeader(context.Background(), "lfs", "f110/test1", "1234567890")
+		if h["x-amz-server-side-encryption"] != "aws:kms" || h["x-amz-server-side-encryption-aws-kms-key-id"] != "alias/lfs" {
+			t.Errorf("unexpected upload header: %v", h)
+		}
+		if h := amazonS3.DownloadHeader(context.Background(), "lfs", "f110/test1", "1234567890"); len(h) != 0 {
+			t.Errorf("unexpected download header: %v", h)
+		}
+	})
+
+	t.Run("sse-c", func(t *testing.T) {
+		key := bytes.Repeat([]byte("k"), 32)
+		amazonS3 := newStorage(encryptionConfig{Encryption: EncryptionSSEC, CustomerKey: base64.StdEncoding.EncodeToString(key)})
+		if _, err := amazonS3.Stat(context.Background(), "lfs", "f110/test1", "1234567890"); err != nil {
+			t.Fatal(err)
+		}
+		h := amazonS3.DownloadHeader(context.Background(), "lfs", "f110/test1", "1234567890")
+		for k, v := range h {
+			if header.Get(k) != v {
+				t.Errorf("%s is not sent: %s", k, header.Get(k))
+			}
+		}
+		if h["x-amz-server-side-encryption-customer-key"] != base64.StdEncoding.EncodeToString(key) {
+			t.Errorf("unexpected download header: %v", h)
+		}
+		if len(amazonS3.UploadHeader(context.Background(), "lfs", "f110/test1", "1234567890")) != 3 {
+			t.Error("upload header doesn't have the customer key")
+		}
+	})
+
+	_, err = newEncryption(encryptionConfig{Encryption: EncryptionSSEC, CustomerKey: "c2hvcnQ="}, EncryptionSSEC)
+	if err == nil {
+		t.Error("short customer key is accepted")
+	}
+	_, err = newEncryption(encryptionConfig{Encryption: EncryptionCMEK}, EncryptionSSES3, EncryptionSSEKMS, EncryptionSSEC)
+	if err == nil {
+		t.Error("cmek is accepted by s3")
+	}
+}
+
+// mockS3List returns the keys by pages which have 2 keys at most.
+type mockS3List struct {
+	s3iface.S3API
+	keys []string
+}
+
+func (m *mockS3List) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	start := 0
+	if input.ContinuationToken != nil {
+		start, _ = strconv.Atoi(aws.StringValue(input.ContinuationToken))
+	}
+	res := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	for i := start; i < len(m.keys); i++ {
+		if len(res.Contents) == 2 {
+			res.IsTruncated = aws.Bool(true)
+			res.NextContinuationToken = aws.String(strconv.Itoa(i))
+			break
+		}
+		if strings.HasPrefix(m.keys[i], aws.StringValue(input.Prefix)) == false {
+			continue
+		}
+		res.Contents = append(res.Contents, &s3.Object{Key: aws.String(m.keys[i]), Size: aws.Int64(int64(i)), LastModified: aws.Time(time.Now())})
+	}
+	return res, nil
+}
+
+func TestAmazonS3_List(t *testing.T) {
+	mock := &mockS3List{keys: []string{
+		"lfs/f110/test1/11/11/" + oid1,
+		"lfs/f110/test1/22/22/" + oid2,
+		"lfs/f110/test1/22/22/." + oid2 + ".part",
+		"lfs/f110/test1/33/33/" + oid3,
+		"lfs/f110/test10/44/44/" + oid4,
+	}}
+	amazonS3 := newAmazonS3(mock, time.Minute, s3manager.MinUploadPartSize, 1)
+	amazonS3.layout = &KeyLayout{Prefix: "lfs", Shard: true}
+
+	listed := make([]string, 0)
+	cursor := ""
+	pages := 0
+	for {
+		objects, next, err := amazonS3.List(context.Background(), "lfs-objects", "f110/test1", cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, o := range objects {
+			listed = append(listed, o.ObjectID)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if pages != 3 || strings.Join(listed, ",") != oid1+","+oid2+","+oid3 {
+		t.Errorf("unexpected objects: %v in %d pages", listed, pages)
+	}
+}
+
+// mockS3Range returns the whole content whatever the range is, like S3 does for the invalid range.
+type mockS3Range struct {
+	s3iface.S3API
+	content []byte
+	ranges  []string
+}
+
+func (m *mockS3Range) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	m.ranges = append(m.ranges, aws.StringValue(input.Range))
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(m.content))}, nil
+}
+
+func TestAmazonS3_GetObjectRange(t *testing.T) {
+	mock := &mockS3Range{content: []byte("hello world")}
+	amazonS3 := newAmazonS3(mock, time.Minute, s3manager.MinUploadPartSize, 1)
+
+	r, err := amazonS3.GetObjectRange(context.Background(), "lfs-objects", "f110/test1", oid1, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(r)
+	r.Close()
+	if len(buf) != 0 || len(mock.ranges) != 0 {
+		t.Errorf("unexpected content of zero bytes: %q %v", buf, mock.ranges)
+	}
+
+	r, err = amazonS3.GetObjectRange(context.Background(), "lfs-objects", "f110/test1", oid1, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if len(mock.ranges) != 1 || mock.ranges[0] != "bytes=5-7" {
+		t.Errorf("unexpected range: %v", mock.ranges)
+	}
+}
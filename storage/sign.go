@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	ObjectPathPrefix = "/storage/"
+)
+
+// urlSigner signs the URL which is served by lfs server itself.
+// Signed URL has an expiration like presigned URL of cloud storage.
+type urlSigner struct {
+	key []byte
+}
+
+// newURLSigner returns the signer of the key.
+// The key is not generated because the signed URL has to be verified by every lfs server and after restarting.
+func newURLSigner(key []byte) (*urlSigner, error) {
+	if len(key) == 0 {
+		return nil, errors.New("signing_key is required")
+	}
+	return &urlSigner{key: key}, nil
+}
+
+func (s *urlSigner) signature(method, path string, expires int64, params url.Values) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(method + "\n" + path + "\n" + strconv.FormatInt(expires, 10) + "\n" + params.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the URL which is baseURL + path with the signature.
+// params are added to the query and also signed.
+func (s *urlSigner) Sign(method, baseURL, path string, params url.Values, expire time.Duration) string {
+	expires := time.Now().Add(expire).Unix()
+	q := url.Values{}
+	for k, v := range params {
+		q[k] = v
+	}
+	sig := s.signature(method, path, expires, q)
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("signature", sig)
+	return baseURL + path + "?" + q.Encode()
+}
+
+// Verify reports whether req has a valid and unexpired signature for method.
+func (s *urlSigner) Verify(req *http.Request, method string) bool {
+	q := req.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return false
+	}
+	if time.Now().Unix() > expires {
+		return false
+	}
+	sig, err := hex.DecodeString(q.Get("signature"))
+	if err != nil {
+		return false
+	}
+	q.Del("expires")
+	q.Del("signature")
+	expected, _ := hex.DecodeString(s.signature(method, req.URL.Path, expires, q))
+	return hmac.Equal(sig, expected)
+}
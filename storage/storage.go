@@ -3,25 +3,67 @@ package storage
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"time"
 )
 
 var (
+	// URLExpire is the default expiration of the presigned URL.
 	URLExpire = 10 * time.Minute
 )
 
+var (
+	ErrObjectNotExist = errors.New("object does not exist")
+)
+
+type ObjectInfo struct {
+	Size         int64
+	LastModified time.Time
+}
+
 type Storage interface {
-	Get(bucketName string, repo string, objectID string) (url string, err error)
+	Get(ctx context.Context, bucketName string, repo string, objectID string) (url string, err error)
 	GetObject(ctx context.Context, bucketName string, repo string, objectID string) (object io.ReadCloser, err error)
-	Put(bucketName string, repo string, objectID string) (url string, err error)
+	Put(ctx context.Context, bucketName string, repo string, objectID string) (url string, err error)
 	PutObject(ctx context.Context, bucketName string, repo string, objectID string) (object io.WriteCloser, err error)
+	// Stat returns ErrObjectNotExist if the object is not found.
+	Stat(ctx context.Context, bucketName string, repo string, objectID string) (info *ObjectInfo, err error)
+	// List returns objects of the repository after cursor, and the cursor of the next page.
+	// The empty cursor starts from the first object, and the empty next cursor means the end of objects.
+	List(ctx context.Context, bucketName string, repo string, cursor string) (objects []*ListedObject, next string, err error)
+	// Delete removes the object. It doesn't return an error if the object is not found.
+	Delete(ctx context.Context, bucketName string, repo string, objectID string) error
+}
+
+// ListedObject is the object which is returned by List.
+type ListedObject struct {
+	ObjectID     string
+	Size         int64
+	LastModified time.Time
+}
+
+// HeaderStorage is implemented by the storage which requires the headers on the request to the signed URL.
+type HeaderStorage interface {
+	UploadHeader(ctx context.Context, bucketName string, repo string, objectID string) map[string]string
+	DownloadHeader(ctx context.Context, bucketName string, repo string, objectID string) map[string]string
+}
+
+// AbortWriter aborts the writer returned by PutObject so that the partially written object is discarded.
+// If the writer doesn't support aborting, the writer is just closed.
+func AbortWriter(w io.WriteCloser, err error) error {
+	if aw, ok := w.(interface {
+		CloseWithError(error) error
+	}); ok {
+		return aw.CloseWithError(err)
+	}
+	return w.Close()
 }
 
 type Nop struct{}
 
-func (*Nop) Get(bucketName string, repo string, objectID string) (url string, err error) {
+func (*Nop) Get(ctx context.Context, bucketName string, repo string, objectID string) (url string, err error) {
 	return "http://example.com/lfs/objects/" + bucketName + "/" + repo + "/" + objectID, nil
 }
 
@@ -29,7 +71,7 @@ func (*Nop) GetObject(ctx context.Context, bucketName string, repo string, objec
 	return ioutil.NopCloser(bytes.NewBuffer([]byte{})), nil
 }
 
-func (*Nop) Put(bucketName string, repo string, objectID string) (url string, err error) {
+func (*Nop) Put(ctx context.Context, bucketName string, repo string, objectID string) (url string, err error) {
 	return "https://example.com/lfs/objects/" + bucketName + "/" + repo + "/" + objectID, nil
 }
 
@@ -37,3 +79,15 @@ func (*Nop) PutObject(ctx context.Context, bucketName string, repo string, objec
 	_, w := io.Pipe()
 	return w, nil
 }
+
+func (*Nop) Stat(ctx context.Context, bucketName string, repo string, objectID string) (info *ObjectInfo, err error) {
+	return &ObjectInfo{}, nil
+}
+
+func (*Nop) List(ctx context.Context, bucketName string, repo string, cursor string) (objects []*ListedObject, next string, err error) {
+	return nil, "", nil
+}
+
+func (*Nop) Delete(ctx context.Context, bucketName string, repo string, objectID string) error {
+	return nil
+}
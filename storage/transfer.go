@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"context"
+)
+
+const (
+	TransferBasic     = "basic"
+	TransferMultipart = "multipart-basic"
+	TransferTus       = "tus"
+	TusVersion        = "1.0.0"
+)
+
+// ResumableStorage is implemented by the storage which accepts the resumable upload by tus protocol.
+type ResumableStorage interface {
+	PutResumable(ctx context.Context, bucketName string, repo string, objectID string, size int64) (url string, err error)
+}
+
+// TransferAdapters returns the names of transfer adapters which s supports.
+// The storage declares the supported adapters by TransferAdapters method.
+// If not declared, the adapters are derived from the interfaces which s implements.
+func TransferAdapters(s Storage) []string {
+	if t, ok := s.(interface {
+		TransferAdapters() []string
+	}); ok {
+		return t.TransferAdapters()
+	}
+
+	adapters := make([]string, 0)
+	if _, ok := s.(MultipartStorage); ok {
+		adapters = append(adapters, TransferMultipart)
+	}
+	if _, ok := s.(ResumableStorage); ok {
+		adapters = append(adapters, TransferTus)
+	}
+	return append(adapters, TransferBasic)
+}
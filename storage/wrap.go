@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/f110/git-lfs-cloud/config"
+)
+
+// bucketStorage is the storage which is wrapped by the driver and the bucket of it.
+type bucketStorage struct {
+	Storage
+	bucket string
+	// name identifies the backend by the driver and the bucket (e.g. s3/lfs-replica)
+	name string
+}
+
+// openBackend opens the storage which is wrapped by the driver.
+// If the backend doesn't specify the bucket, the bucket of the repository is used.
+func openBackend(conf *config.Config, repoConf, backendConf *config.RepositoryConfig) (*bucketStorage, error) {
+	if backendConf == nil {
+		return nil, errors.New("backend is required")
+	}
+	c := *backendConf
+	c.Owner, c.Repo = repoConf.Owner, repoConf.Repo
+	if c.Bucket == "" {
+		c.Bucket = repoConf.Bucket
+	}
+	if c.SigningKey == "" {
+		c.SigningKey = repoConf.SigningKey
+	}
+	s, err := Open(conf, &c)
+	if err != nil {
+		return nil, err
+	}
+	driver := c.Storage
+	if driver == "" {
+		driver = conf.Storage
+	}
+	return &bucketStorage{Storage: s, bucket: c.Bucket, name: driver + "/" + c.Bucket}, nil
+}
+
+// objectServer serves objects of the storage through lfs server by the signed URL.
+// It is used by the storage which can't let the client access the backend directly.
+type objectServer struct {
+	storage Storage
+	bucket  string
+	baseURL string
+	signer  *urlSigner
+	expire  time.Duration
+}
+
+func newObjectServer(conf *config.Config, repoConf *config.RepositoryConfig, s Storage) (*objectServer, error) {
+	signer, err := newURLSigner([]byte(repoConf.SigningKey))
+	if err != nil {
+		return nil, err
+	}
+	return &objectServer{
+		storage: s,
+		bucket:  repoConf.Bucket,
+		baseURL: strings.TrimSuffix(conf.BaseURL(), "/"),
+		signer:  signer,
+		expire:  urlExpire(repoConf),
+	}, nil
+}
+
+func (o *objectServer) url(method, repo, objectID string) (string, error) {
+	if validObjectID(objectID) == false {
+		return "", ErrInvalidObjectID
+	}
+	return o.signer.Sign(method, o.baseURL, ObjectPathPrefix+repo+"/"+objectID, nil, o.expire), nil
+}
+
+// ServeHTTP streams the object from or to the storage.
+func (o *objectServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if o.signer.Verify(req, req.Method) == false {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	p := strings.TrimPrefix(req.URL.Path, ObjectPathPrefix)
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		http.NotFound(w, req)
+		return
+	}
+	repo, objectID := p[:i], p[i+1:]
+
+	switch req.Method {
+	case http.MethodGet:
+		info, err := o.storage.Stat(req.Context(), o.bucket, repo, objectID)
+		if err == ErrObjectNotExist || err == ErrInvalidObjectID {
+			http.NotFound(w, req)
+			return
+		}
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "failed to stat object", http.StatusInternalServerError)
+			return
+		}
+		r, err := o.storage.GetObject(req.Context(), o.bucket, repo, objectID)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "failed to read object", http.StatusInternalServerError)
+			return
+		}
+		defer r.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, r); err != nil {
+			log.Print(err)
+		}
+	case http.MethodPut:
+		writer, err := o.storage.PutObject(req.Context(), o.bucket, repo, objectID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := io.Copy(writer, req.Body); err != nil {
+			AbortWriter(writer, err)
+			log.Print(err)
+			http.Error(w, "failed to write object", http.StatusInternalServerError)
+			return
+		}
+		if err := writer.Close(); err != nil {
+			log.Print(err)
+			http.Error(w, "failed to write object", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}